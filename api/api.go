@@ -1,6 +1,7 @@
 package api
 
 import (
+	"crypto/ed25519"
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
@@ -17,14 +18,29 @@ import (
 	"strings"
 
 	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
 	"github.com/moio/booster/wharf"
 	"github.com/pkg/errors"
 )
 
+// validHash matches hashes returned by PrepareDiff (hex-encoded SHA-512)
+var validHash = regexp.MustCompile("^[0-9a-f]{128}$")
+
+// verdictsFileName is the name of the index of decompression verdicts, in the booster-specific dir
+const verdictsFileName = "verdicts.json"
+
 // Serve serves the HTTP API
-func Serve(basedir string, port int, primary string) error {
+// patches are signed with signKey, if not nil. Patches from primary are checked by verifier
+// if reconstruct is true, any gzip layer is decompressed along with reconstruction data (must match on primary and replicas)
+// decompression verdicts are kept in the booster-specific dir, so that blobs are only decompressed once
+func Serve(basedir string, port int, primary string, signKey ed25519.PrivateKey, verifier *patch.Verifier, reconstruct bool) error {
+	verdicts, err := gzip.LoadVerdicts(path.Join(basedir, "booster", verdictsFileName))
+	if err != nil {
+		return err
+	}
+
 	http.HandleFunc("/prepare_diff", func(writer http.ResponseWriter, request *http.Request) {
-		if err := PrepareDiff(basedir, writer, request); err != nil {
+		if err := PrepareDiff(basedir, signKey, reconstruct, verdicts, writer, request); err != nil {
 			abort(err, writer)
 		}
 	})
@@ -35,14 +51,20 @@ func Serve(basedir string, port int, primary string) error {
 		}
 	})
 
+	http.HandleFunc("/signature", func(writer http.ResponseWriter, request *http.Request) {
+		if err := Signature(basedir, writer, request); err != nil {
+			abort(err, writer)
+		}
+	})
+
 	http.HandleFunc("/sync", func(writer http.ResponseWriter, request *http.Request) {
-		if err := Sync(basedir, primary, writer, request); err != nil {
+		if err := Sync(basedir, primary, verifier, reconstruct, verdicts, writer, request); err != nil {
 			abort(err, writer)
 		}
 	})
 
 	http.HandleFunc("/cleanup", func(writer http.ResponseWriter, request *http.Request) {
-		if err := Cleanup(basedir, writer, request); err != nil {
+		if err := Cleanup(basedir, verdicts, writer, request); err != nil {
 			abort(err, writer)
 		}
 	})
@@ -58,20 +80,33 @@ type PrepareDiffResp struct {
 }
 
 // PrepareDiff computes the patch between (decompressed) files in basedir and files passed in
-// the request body.
+// the request body. Passed files which are decompressed here are taken as decompressed on the replica too
 // The result is cached in a temporary directory by hash, returned in the response body
-func PrepareDiff(basedir string, w http.ResponseWriter, r *http.Request) error {
-	// determine old files, passed as parameter
-	oldFiles := util.NewFileSet()
-	for _, f := range strings.Split(r.FormValue("old"), "\n") {
-		oldFiles.Add(path.Join(basedir, f))
+// If signKey is not nil, the patch is signed
+// If reconstruct is true, any gzip layer is decompressed along with reconstruction data
+// Blobs verdicts has as not recompressible are not decompressed again, new verdicts are saved
+// The replica's encoder version, if passed, has to match ours for it to recompress layers to the same digests
+func PrepareDiff(basedir string, signKey ed25519.PrivateKey, reconstruct bool, verdicts *gzip.Verdicts, w http.ResponseWriter, r *http.Request) error {
+	if encoder := r.FormValue("encoder"); encoder != "" && encoder != gzip.EncoderVersion {
+		return errors.Errorf("PrepareDiff: replica has encoder version %v, but primary has %v: upgrade booster so that they match", encoder, gzip.EncoderVersion)
 	}
 
 	// determine new files, which is all files we have in decompressed form only
-	newFiles, err := gzip.DecompressWalking(basedir)
+	newFiles, err := gzip.DecompressWalking(basedir, reconstruct, verdicts)
 	if err != nil {
 		return errors.Wrap(err, "PrepareDiff: error while decompressing files")
 	}
+	if err := verdicts.Save(); err != nil {
+		return errors.Wrap(err, "PrepareDiff")
+	}
+
+	// determine old files, passed as parameter, in the form the replica will decompress them to
+	oldFiles := util.NewFileSet()
+	for _, f := range strings.Split(r.FormValue("old"), "\n") {
+		for _, p := range decompressedForm(path.Join(basedir, f), newFiles) {
+			oldFiles.AddWithParents(p)
+		}
+	}
 
 	// compute a unique hash for this diff
 	h, err := hash(oldFiles, newFiles)
@@ -103,6 +138,13 @@ func PrepareDiff(basedir string, w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	signaturePath := patchPath + patch.SignatureSuffix
+	if _, err := os.Stat(signaturePath); signKey != nil && os.IsNotExist(err) {
+		if err := patch.Sign(patchPath, signaturePath, signKey); err != nil {
+			return errors.Wrap(err, "PrepareDiff: error while signing patch")
+		}
+	}
+
 	// return the unique hash in the response
 	response, err := json.Marshal(PrepareDiffResp{Hash: h})
 	if err != nil {
@@ -120,26 +162,53 @@ func PrepareDiff(basedir string, w http.ResponseWriter, r *http.Request) error {
 func Diff(basedir string, w http.ResponseWriter, r *http.Request) error {
 	h := r.FormValue("hash")
 
-	log.Info().Str("hash", h[:10]).Msg("Serving patch")
-
 	// sanitize input
-	if _, err := regexp.MatchString("[0-9a-f]", h); err != nil {
+	if !validHash.MatchString(h) {
 		return errors.Wrap(errors.Errorf("invalid hash %v", h), "Diff: hash validation error")
 	}
 
+	log.Info().Str("hash", h[:10]).Msg("Serving patch")
+
 	http.ServeFile(w, r, path.Join(basedir, "booster", h))
 	return nil
 }
 
+// Signature serves the signature of a patch previously computed via PrepareDiff, if signed.
+// It expects a hash value as parameter
+func Signature(basedir string, w http.ResponseWriter, r *http.Request) error {
+	h := r.FormValue("hash")
+
+	// sanitize input
+	if !validHash.MatchString(h) {
+		return errors.Wrap(errors.Errorf("invalid hash %v", h), "Signature: hash validation error")
+	}
+
+	http.ServeFile(w, r, path.Join(basedir, "booster", h+patch.SignatureSuffix))
+	return nil
+}
+
+// decompressedForm returns the paths of the decompressed file and sidecars f has in newFiles, if any, or f
+func decompressedForm(f string, newFiles *util.FileSet) []string {
+	for _, p := range gzip.DecompressedPaths(f) {
+		if newFiles.Present(p) {
+			return gzip.WithSidecars(p)
+		}
+	}
+	return []string{f}
+}
+
 // Sync requests the patch from the set of files in path to the set of files on the primary
-// and applies it locally
-func Sync(path string, primary string, w http.ResponseWriter, r *http.Request) error {
-	// determine new files, which is all files we have in decompressed form only
-	decompressed, err := gzip.DecompressWalking(path)
+// and applies it locally, after checking its signature with verifier
+// Files are only decompressed once the patch is verified, and only if the patch applies to their decompressed form
+// If reconstruct is true, any gzip layer is decompressed along with reconstruction data
+// Blobs verdicts has as not recompressible are not decompressed again, new verdicts are saved
+func Sync(path string, primary string, verifier *patch.Verifier, reconstruct bool, verdicts *gzip.Verdicts, w http.ResponseWriter, r *http.Request) error {
+	// determine old files, which the primary maps to the form it decompresses them to
+	files, err := gzip.FilesToDecompress(path)
 	if err != nil {
-		return errors.Wrap(err, "Sync: error while decompressing files")
+		return errors.Wrap(err, "Sync: error while listing files")
 	}
-	relative, err := decompressed.Relative(path)
+	relative, err := files.Relative(path)
 	if err != nil {
 		return errors.Wrap(err, "Sync: error while computing request to primary")
 	}
@@ -148,7 +217,7 @@ func Sync(path string, primary string, w http.ResponseWriter, r *http.Request) e
 
 	resp, err := http.PostForm(
 		primary+"/prepare_diff",
-		url.Values{"old": {strings.Join(relative.Sorted(), "\n")}})
+		url.Values{"old": {strings.Join(relative.Sorted(), "\n")}, "encoder": {gzip.EncoderVersion}})
 	if err != nil {
 		return errors.Wrap(err, "Sync: error requesting diff preparation to primary")
 	}
@@ -165,11 +234,44 @@ func Sync(path string, primary string, w http.ResponseWriter, r *http.Request) e
 	}
 
 	h := prepareResp.Hash
-	log.Info().Str("hash", h[:10]).Msg("Downloading and applying patch...")
+	if !validHash.MatchString(h) {
+		return errors.Errorf("Sync: invalid hash from primary: %v", h)
+	}
+	log.Info().Str("hash", h[:10]).Msg("Downloading patch...")
+
+	// the patch is downloaded in full, so that the signature is checked on the same bytes that are applied
+	patchDir := filepath.Join(os.TempDir(), "booster", "patches")
+	if err := os.MkdirAll(patchDir, 0700); err != nil {
+		return errors.Wrap(err, "Sync: error while creating patch directory")
+	}
+	patchPath := filepath.Join(patchDir, h)
+	signaturePath := patchPath + patch.SignatureSuffix
+	defer os.Remove(patchPath)
+	defer os.Remove(signaturePath)
+
+	found, err := download(primary+"/diff?hash="+h, patchPath)
+	if err != nil {
+		return errors.Wrap(err, "Sync: error while downloading patch")
+	}
+	if !found {
+		return errors.Errorf("Sync: patch %v not found on primary", h)
+	}
+	if _, err := download(primary+"/signature?hash="+h, signaturePath); err != nil {
+		return errors.Wrap(err, "Sync: error while downloading patch signature")
+	}
+	if err := verifier.Verify(patchPath, signaturePath); err != nil {
+		return errors.Wrap(err, "Sync")
+	}
+
+	if err := decompressPatched(path, relative, patchPath, reconstruct, verdicts); err != nil {
+		return errors.Wrap(err, "Sync")
+	}
+
+	log.Info().Str("hash", h[:10]).Msg("Applying patch...")
 
 	tempDir := filepath.Join(os.TempDir(), "booster", "staging")
 
-	size, err := wharf.Apply(primary+"/diff?hash="+h, path, tempDir)
+	size, err := applyPatch(patchPath, path, tempDir)
 	if err != nil {
 		return errors.Wrap(err, "Sync: error while applying patch")
 	}
@@ -183,11 +285,88 @@ func Sync(path string, primary string, w http.ResponseWriter, r *http.Request) e
 	return nil
 }
 
-// Cleanup removes any booster-specific file
-func Cleanup(basedir string, writer http.ResponseWriter, request *http.Request) error {
+// applyPatch applies the patch file at patchPath to directory. Returns the patch size
+func applyPatch(patchPath string, directory string, tempDir string) (int64, error) {
+	f, err := os.Open(patchPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), wharf.Apply(f, info.Size(), 0, directory, tempDir)
+}
+
+// decompressPatched decompresses those files in directory the patch at patchPath applies to in decompressed form
+// files are relative to directory
+func decompressPatched(directory string, files *util.FileSet, patchPath string, reconstruct bool, verdicts *gzip.Verdicts) error {
+	f, err := os.Open(patchPath)
+	if err != nil {
+		return errors.Wrap(err, "error while opening patch")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "error while opening patch")
+	}
+	patchInfo, err := wharf.Inspect(f, info.Size(), 0)
+	if err != nil {
+		return errors.Wrap(err, "error while inspecting patch")
+	}
+	oldPaths := map[string]bool{}
+	for _, file := range patchInfo.OldContainer.Files {
+		oldPaths[file.Path] = true
+	}
+
+	toDecompress := util.NewFileSet()
+	files.Walk(func(file string) {
+		for _, p := range gzip.DecompressedPaths(filepath.ToSlash(file)) {
+			if oldPaths[p] {
+				toDecompress.Add(filepath.Join(directory, file))
+			}
+		}
+	})
+
+	gzip.Decompress(toDecompress, reconstruct, verdicts)
+	return verdicts.Save()
+}
+
+// download downloads url to path. Returns false, without creating path, if the server responds 404
+func download(url string, path string) (bool, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return false, errors.Errorf("obtained error from primary: %v", string(bodyBytes))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// Cleanup removes any booster-specific file, including verdicts
+func Cleanup(basedir string, verdicts *gzip.Verdicts, writer http.ResponseWriter, request *http.Request) error {
 	if err := os.RemoveAll(path.Join(basedir, "booster")); err != nil {
 		return err
 	}
+	verdicts.Clear()
 	return gzip.Clean(basedir)
 }
 
@@ -1,45 +1,105 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"github.com/containers/image/v5/copy"
-	"github.com/containers/image/v5/docker"
-	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
 	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
 	"github.com/moio/booster/wharf"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"path/filepath"
+	"strconv"
 )
 
-func Apply(oldList string, newList string, patchPath string, tempDir string, destination string) error {
-	oldImages, err := readLines(oldList)
-	if err != nil {
-		return err
+// Apply downloads the old set of images from oldSource (or destination, if empty) in tempDir, applies the patches
+// at patchPaths in order to obtain the new set of images and uploads them to destination,
+// along with their signatures, attestations, SBOMs and OCI referrers
+// image sets are described in patch headers, each patch must apply to the new set of the previous one.
+// Layers are decompressed and recompressed only once for the whole chain
+// oldSource is accessed via srcCtx, destination via destCtx. rewrites are applied to image names in both
+// images for platforms are selected from multi-platform images, if platforms is empty the first patch's selection is used
+// if dryRun is true, old images are downloaded, decompressed and checked against the first patch, then references,
+// tags pushed or overwritten and size estimates are printed and nothing is uploaded
+// patch signatures are checked with verifier before anything else
+func Apply(patchPaths []string, tempDir string, destination string, oldSource string, rewrites Rewrites, srcCtx *types.SystemContext, destCtx *types.SystemContext, platforms patch.PlatformSelection, downloadOptions DownloadOptions, dryRun bool, verifier *patch.Verifier) error {
+	headers := make([]*patch.Header, len(patchPaths))
+	offsets := make([]int64, len(patchPaths))
+	for i, patchPath := range patchPaths {
+		// split patches are signed via their index, which lists volume digests
+		signedPath, _ := patch.IndexPath(patchPath)
+		if err := verifier.Verify(signedPath, signedPath+patch.SignatureSuffix); err != nil {
+			return err
+		}
+		if err := checkVolumes(patchPath); err != nil {
+			return err
+		}
+
+		header, offset, err := readHeader(patchPath)
+		if err != nil {
+			return err
+		}
+		log.Info().Str("patch", patchPath).Str("booster_version", header.BoosterVersion).Msg("Processing")
+
+		if i > 0 {
+			if err := checkDigests(header.OldImages, headers[i-1].NewImages); err != nil {
+				return errors.Wrapf(err, "Patch %v does not apply to the result of %v", patchPath, patchPaths[i-1])
+			}
+		}
+		headers[i] = header
+		offsets[i] = offset
 	}
-	newImages, err := readLines(newList)
-	if err != nil {
-		return err
+	gzipReconstruction := headers[0].Settings.GzipReconstruction
+	for i, header := range headers {
+		if header.Settings.GzipReconstruction != gzipReconstruction {
+			return errors.Errorf("Patches %v and %v were created with different gzip reconstruction settings", patchPaths[0], patchPaths[i])
+		}
+		if !samePlatforms(header.Settings.Platforms, headers[0].Settings.Platforms) {
+			return errors.Errorf("Patches %v and %v were created with different platform selections", patchPaths[0], patchPaths[i])
+		}
+		if err := checkDeflateEncoder(patchPaths[i], header.Settings.DeflateEncoder); err != nil {
+			return err
+		}
+	}
+	oldImages := headers[0].OldImages
+	newImages := headers[len(headers)-1].NewImages
+
+	if !platforms.All && len(platforms.Platforms) == 0 {
+		platforms = headers[0].Settings.Platforms
 	}
 
-	log.Info().Str("list", oldList).Msg("Processing")
+	if oldSource == "" {
+		oldSource = destination
+		srcCtx = destCtx
+	}
 
 	imageTempDir := filepath.Join(tempDir, "images")
-	oldFiles, err := downloadAll(oldImages, imageTempDir)
+	oldFiles, oldDigests, err := downloadAll(oldImages, oldSource, rewrites, srcCtx, platforms, downloadOptions, imageTempDir, nil)
 	if err != nil {
-		return errors.Wrapf(err, "Error while computing diff")
+		return errors.Wrapf(err, "Error while downloading old images")
+	}
+	if err := checkDigests(oldImages, oldDigests); err != nil {
+		return errors.Wrapf(err, "Patch does not apply to %v", oldSource)
+	}
+	uncompressedOldFiles := gzip.Decompress(oldFiles, gzipReconstruction, nil)
+	if dryRun {
+		if err := checkOldFiles(patchPaths[0], offsets[0], imageTempDir, uncompressedOldFiles); err != nil {
+			return errors.Wrapf(err, "Patch %v does not apply to %v", patchPaths[0], oldSource)
+		}
+		return printPlan(patchPaths, offsets, headers, imageTempDir, oldFiles, oldSource, destination, rewrites, destCtx)
 	}
-	gzip.Decompress(oldFiles)
 
-	log.Info().Str("patch", patchPath).Msg("Applying")
+	for i, patchPath := range patchPaths {
+		log.Info().Str("patch", patchPath).Msg("Applying")
 
-	patchTempDir := filepath.Join(tempDir, "patch")
-	_, err = wharf.Apply(patchPath, imageTempDir, patchTempDir)
-	if err != nil {
-		return errors.Wrap(err, "Error while applying patch")
+		patchTempDir := filepath.Join(tempDir, "patch", strconv.Itoa(i))
+		if err := applyPatch(patchPath, offsets[i], imageTempDir, patchTempDir); err != nil {
+			return errors.Wrapf(err, "Error while applying patch %v", patchPath)
+		}
 	}
 
 	if err := gzip.RecompressAllIn(tempDir); err != nil {
@@ -47,50 +107,124 @@ func Apply(oldList string, newList string, patchPath string, tempDir string, des
 	}
 
 	for _, image := range newImages {
-		if err = upload(image, imageTempDir, destination); err != nil {
+		if err = upload(image, imageTempDir, destination, rewrites, destCtx, platforms); err != nil {
 			return errors.Wrapf(err, "Error while uploading to destination")
 		}
 	}
+	if err := uploadArtifacts(headers[len(headers)-1].Artifacts, newImages, imageTempDir, destination, rewrites, destCtx); err != nil {
+		return errors.Wrapf(err, "Error while uploading to destination")
+	}
 
 	log.Info().Msg("All done!")
 
 	return nil
 }
 
-func upload(image string, sourcePath string, destinationRegistry string) error {
-	log.Info().Str("image", image).Msg("Uploading")
+// readHeader reads the header of the patch at patchPath (a patch file, or the index or first volume of a split patch)
+// returns the header and the offset of the wharf patch stream
+func readHeader(patchPath string) (*patch.Header, int64, error) {
+	f, err := patch.Open(patchPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	header, offset, err := patch.ReadHeader(bufio.NewReader(f))
+	if closeErr := f.Close(); closeErr != nil {
+		return nil, 0, errors.Wrapf(closeErr, "Error while closing patch file %v", patchPath)
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Error while reading patch file %v", patchPath)
+	}
+	return header, offset, nil
+}
+
+// checkVolumes returns an error naming any missing or corrupt volume of the patch at patchPath, if split
+func checkVolumes(patchPath string) error {
+	f, err := patch.Open(patchPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.CheckVolumes(); err != nil {
+		return errors.Wrapf(err, "Error while checking patch file %v", patchPath)
+	}
+	return nil
+}
+
+// applyPatch applies the wharf patch stream, starting at offset, of the patch at patchPath to directory
+func applyPatch(patchPath string, offset int64, directory string, tempDir string) error {
+	f, err := patch.Open(patchPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return wharf.Apply(f, f.Size(), offset, directory, tempDir)
+}
+
+// checkDigests returns an error if actual image digests differ from expected ones
+func checkDigests(expected []patch.Image, actual []patch.Image) error {
+	if len(expected) != len(actual) {
+		return errors.Errorf("expected %v images, got %v", len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i].Name != actual[i].Name || expected[i].Digest != actual[i].Digest {
+			return errors.Errorf("image %v has digest %v, expected %v", actual[i].Name, actual[i].Digest, expected[i].Digest)
+		}
+	}
+	return nil
+}
+
+// upload uploads an image from the OCI layout in sourcePath to destination via sys, applying rewrites to its name
+// images for platforms are selected if the image is a multi-platform image
+func upload(image patch.Image, sourcePath string, destination string, rewrites Rewrites, sys *types.SystemContext, platforms patch.PlatformSelection) error {
+	log.Info().Str("image", image.Name).Msg("Uploading")
 
 	policy, err := signature.DefaultPolicy(nil)
 	if err != nil {
-		return errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image)
+		return errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image.Name)
 	}
 	policyContext, err := signature.NewPolicyContext(policy)
 	if err != nil {
-		return errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image)
+		return errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image.Name)
 	}
 
-	named, err := reference.ParseNormalizedNamed(destinationRegistry + "/" + image)
+	destRef, err := destinationReference(destination, image, rewrites)
 	if err != nil {
-		return errors.Wrapf(err, "Error parsing reference: %v", image)
+		return err
 	}
-	destRef, err := docker.NewReference(reference.TagNameOnly(named))
+
+	name, err := imageName(image.Name)
 	if err != nil {
-		return errors.Wrapf(err, "Error parsing reference: %v", image)
+		return err
 	}
-
-	srcRef, err := layout.NewReference(sourcePath, image)
+	srcRef, err := layout.NewReference(sourcePath, name)
 	if err != nil {
-		return errors.Wrapf(err, "Error parsing reference: %v", image)
+		return errors.Wrapf(err, "Error parsing reference: %v", image.Name)
 	}
 
-	_, err = copy.Image(context.Background(), policyContext, destRef, srcRef, &copy.Options{
-		// HACK: allow http, should be passed explicitly via commandline switch
-		DestinationCtx:                        &types.SystemContext{DockerInsecureSkipTLSVerify: types.NewOptionalBool(true)},
-		OptimizeDestinationImageAlreadyExists: true,
-	})
+	options := &copy.Options{DestinationCtx: sys, OptimizeDestinationImageAlreadyExists: true}
+	if err := selectPlatforms(options, srcRef, sys, platforms); err != nil {
+		return errors.Wrapf(err, "Error selecting platforms for image: %v", image.Name)
+	}
+
+	_, err = copy.Image(context.Background(), policyContext, destRef, srcRef, options)
 	if err != nil {
-		return errors.Wrapf(err, "Error copying image: %v", image)
+		return errors.Wrapf(err, "Error copying image: %v", image.Name)
 	}
 
 	return nil
 }
+
+// checkDeflateEncoder returns an error if the patch at patchPath was created by a booster with a different
+// encoder version than this one, as layers it decompressed could not be recompressed to the same digests
+func checkDeflateEncoder(patchPath string, encoder string) error {
+	if encoder == "" {
+		log.Warn().Str("patch", patchPath).Msg("Patch does not record its encoder version, layers might not be recompressed to the same digests")
+		return nil
+	}
+	if encoder != gzip.EncoderVersion {
+		return errors.Errorf("Patch %v was created with encoder version %v, but this booster has %v: layers would not be recompressed to the same digests. Apply it with a booster with encoder version %v", patchPath, encoder, gzip.EncoderVersion, encoder)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/alitto/pond"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/moio/booster/patch"
+	"github.com/moio/booster/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// artifactTagSuffixes are appended to "sha256-<hex>" tags to obtain tags of related artifacts:
+// the OCI referrers tag itself, then cosign signatures, attestations and SBOMs
+// the OCI 1.1 Referrers API is not queried, so referrers not listed in the referrers tag are not found
+var artifactTagSuffixes = []string{"", ".sig", ".att", ".sbom"}
+
+// artifactTags returns tags that may hold artifacts related to the manifest with digest d
+func artifactTags(d digest.Digest) []string {
+	result := []string{}
+	for _, suffix := range artifactTagSuffixes {
+		result = append(result, d.Algorithm().String()+"-"+d.Encoded()+suffix)
+	}
+	return result
+}
+
+// artifactReference returns a reference to tag in the same repository as ref
+// returns nil if the transport of ref has no notion of tags (eg. dir:)
+func artifactReference(ref types.ImageReference, tag string) (types.ImageReference, error) {
+	switch ref.Transport().Name() {
+	case docker.Transport.Name():
+		tagged, err := reference.WithTag(reference.TrimNamed(ref.DockerReference()), tag)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing reference: %v:%v", ref.DockerReference().Name(), tag)
+		}
+		return docker.NewReference(tagged)
+	case layout.Transport.Name():
+		// "path:name", as in destinationReference
+		parts := strings.SplitN(ref.StringWithinTransport(), ":", 2)
+		name := tag
+		if len(parts) == 2 && parts[1] != "" {
+			repository, _ := splitRepository(parts[1])
+			name = repository + ":" + tag
+		}
+		return layout.NewReference(parts[0], name)
+	}
+	return nil, nil
+}
+
+// artifactSubjects returns digests of manifests artifacts can relate to for an image in the OCI layout in dir:
+// the image manifest and, for multi-platform images, manifests of selected platforms
+func artifactSubjects(image patch.Image, dir string) ([]digest.Digest, error) {
+	result := []digest.Digest{image.Digest}
+	manifestBytes, err := os.ReadFile(blobPath(dir, image.Digest))
+	if err != nil {
+		return nil, err
+	}
+	mimeType := manifest.GuessMIMEType(manifestBytes)
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return result, nil
+	}
+	list, err := manifest.ListFromBlob(manifestBytes, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	for _, instanceDigest := range list.Instances() {
+		if _, err := os.Stat(blobPath(dir, instanceDigest)); err == nil {
+			result = append(result, instanceDigest)
+		}
+	}
+	return result, nil
+}
+
+// downloadArtifacts downloads artifacts related to images (signatures, attestations, SBOMs and OCI referrers)
+// from their own registries via sys into dir, where images were already downloaded, concurrently
+// returns downloaded files and artifacts
+func downloadArtifacts(images []patch.Image, sys *types.SystemContext, options DownloadOptions, dir string) (*util.FileSet, []patch.Artifact, error) {
+	artifacts := make([][]patch.Artifact, len(images))
+	files := make([][]string, len(images))
+	errs := make([]error, len(images))
+
+	pool := pond.New(options.ParallelImages, len(images))
+	for i, image := range images {
+		i, image := i, image
+		pool.Submit(func() {
+			artifacts[i], files[i], errs[i] = downloadImageArtifacts(image, sys, dir)
+		})
+	}
+	pool.StopAndWait()
+
+	fileSet := util.NewFileSet()
+	result := []patch.Artifact{}
+	for i, image := range images {
+		if errs[i] != nil {
+			return nil, nil, errors.Wrapf(errs[i], "Error while downloading artifacts of image %v", image.Name)
+		}
+		for _, file := range files[i] {
+			fileSet.Add(file)
+		}
+		result = append(result, artifacts[i]...)
+	}
+	return fileSet, result, nil
+}
+
+// downloadImageArtifacts downloads artifacts related to an image from its own registry via sys into dir
+// returns artifacts and their files
+func downloadImageArtifacts(image patch.Image, sys *types.SystemContext, dir string) ([]patch.Artifact, []string, error) {
+	srcRef, err := sourceReference("", image, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := imageName(image.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	layoutRef, err := layout.NewReference(dir, name)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Error parsing reference: %v", image.Name)
+	}
+	subjects, err := artifactSubjects(image, dir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error while reading manifest")
+	}
+
+	artifacts := []patch.Artifact{}
+	files := []string{}
+	for _, subject := range subjects {
+		for _, tag := range artifactTags(subject) {
+			from, err := artifactReference(srcRef, tag)
+			if err != nil || from == nil {
+				return artifacts, files, err
+			}
+			_, found, err := currentDigest(from, sys)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Error while looking for artifact: %v", transports.ImageName(from))
+			}
+			if !found {
+				log.Debug().Str("reference", transports.ImageName(from)).Msg("No artifact found")
+				continue
+			}
+			to, err := artifactReference(layoutRef, tag)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			log.Info().Str("image", image.Name).Str("tag", tag).Msg("Downloading artifact")
+			manifestBytes, err := copyArtifact(from, concurrentLayoutReference{to}, sys, nil)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Error copying artifact: %v", transports.ImageName(from))
+			}
+			d, err := manifest.Digest(manifestBytes)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Error computing digest for artifact: %v", transports.ImageName(from))
+			}
+			artifactFiles, err := manifestFiles(manifestBytes, dir)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Error parsing manifest of artifact: %v", transports.ImageName(from))
+			}
+			artifacts = append(artifacts, patch.Artifact{Image: image.Name, Tag: tag, Digest: d})
+			files = append(files, artifactFiles...)
+		}
+	}
+	return artifacts, files, nil
+}
+
+// uploadArtifacts uploads artifacts from the OCI layout in sourcePath to destination via sys, next to the
+// images they relate to (as uploaded by upload)
+func uploadArtifacts(artifacts []patch.Artifact, images []patch.Image, sourcePath string, destination string, rewrites Rewrites, sys *types.SystemContext) error {
+	for _, artifact := range artifacts {
+		to, err := artifactDestinationReference(artifact, images, destination, rewrites)
+		if err != nil {
+			return err
+		}
+		if to == nil {
+			log.Warn().Str("image", artifact.Image).Str("tag", artifact.Tag).Str("destination", destination).Msg("Destination does not support tags, skipping artifact")
+			continue
+		}
+
+		name, err := imageName(artifact.Image)
+		if err != nil {
+			return err
+		}
+		layoutRef, err := layout.NewReference(sourcePath, name)
+		if err != nil {
+			return errors.Wrapf(err, "Error parsing reference: %v", artifact.Image)
+		}
+		from, err := artifactReference(layoutRef, artifact.Tag)
+		if err != nil {
+			return err
+		}
+
+		log.Info().Str("image", artifact.Image).Str("tag", artifact.Tag).Msg("Uploading artifact")
+		if _, err := copyArtifact(from, to, nil, sys); err != nil {
+			return errors.Wrapf(err, "Error copying artifact: %v", transports.ImageName(to))
+		}
+	}
+	return nil
+}
+
+// artifactDestinationReference returns a reference to write artifact to destination, next to the image it
+// relates to among images, or nil if destination has no notion of tags
+func artifactDestinationReference(artifact patch.Artifact, images []patch.Image, destination string, rewrites Rewrites) (types.ImageReference, error) {
+	for _, image := range images {
+		if image.Name != artifact.Image {
+			continue
+		}
+		destRef, err := destinationReference(destination, image, rewrites)
+		if err != nil {
+			return nil, err
+		}
+		return artifactReference(destRef, artifact.Tag)
+	}
+	return nil, errors.Errorf("Artifact %v relates to unknown image %v", artifact.Tag, artifact.Image)
+}
+
+// copyArtifact copies the manifest at srcRef, with any child manifests and blobs, to destRef as is,
+// so that digests (and signatures referring to them) are preserved
+// returns the top-level manifest
+func copyArtifact(srcRef types.ImageReference, destRef types.ImageReference, srcCtx *types.SystemContext, destCtx *types.SystemContext) ([]byte, error) {
+	ctx := context.Background()
+	src, err := srcRef.NewImageSource(ctx, srcCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dest, err := destRef.NewImageDestination(ctx, destCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+
+	manifestBytes, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyManifest(ctx, src, dest, manifestBytes, nil); err != nil {
+		return nil, err
+	}
+	if err := dest.Commit(ctx, image.UnparsedInstance(src, nil)); err != nil {
+		return nil, err
+	}
+	return manifestBytes, nil
+}
+
+// copyManifest copies blobs and child manifests referenced by manifestBytes, then manifestBytes itself
+// instanceDigest is nil for top-level manifests, and the manifest digest for child manifests
+func copyManifest(ctx context.Context, src types.ImageSource, dest types.ImageDestination, manifestBytes []byte, instanceDigest *digest.Digest) error {
+	mimeType := manifest.GuessMIMEType(manifestBytes)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBytes, mimeType)
+		if err != nil {
+			return err
+		}
+		for _, d := range list.Instances() {
+			d := d
+			childBytes, _, err := src.GetManifest(ctx, &d)
+			if err != nil {
+				return err
+			}
+			if err := copyManifest(ctx, src, dest, childBytes, &d); err != nil {
+				return err
+			}
+		}
+	} else {
+		m, err := manifest.FromBlob(manifestBytes, mimeType)
+		if err != nil {
+			return err
+		}
+		if err := copyBlob(ctx, src, dest, m.ConfigInfo(), true); err != nil {
+			return err
+		}
+		for _, layer := range m.LayerInfos() {
+			if err := copyBlob(ctx, src, dest, layer.BlobInfo, false); err != nil {
+				return err
+			}
+		}
+	}
+	return dest.PutManifest(ctx, manifestBytes, instanceDigest)
+}
+
+// copyBlob copies a blob as is, unless already present in dest
+func copyBlob(ctx context.Context, src types.ImageSource, dest types.ImageDestination, blob types.BlobInfo, isConfig bool) error {
+	reused, _, err := dest.TryReusingBlob(ctx, blob, none.NoCache, false)
+	if err != nil {
+		return err
+	}
+	if reused {
+		return nil
+	}
+
+	reader, _, err := src.GetBlob(ctx, blob, none.NoCache)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err := dest.PutBlob(ctx, reader, blob, none.NoCache, isConfig); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// RegistryOptions configures access to registries
+type RegistryOptions struct {
+	// AuthFile is the path to a containers auth.json file
+	// if empty, default locations and credential helpers are used
+	AuthFile string
+	// Creds, if not empty, are credentials in USERNAME:PASSWORD format. They take precedence over AuthFile
+	Creds string
+	// TLSVerify requires HTTPS and certificate verification. If false, HTTP and unverified certificates are accepted
+	TLSVerify bool
+	// CertDir, if not empty, is a directory with *.crt, *.cert and *.key files
+	CertDir string
+	// RegistriesDir, if not empty, overrides the default registries.d directory
+	RegistriesDir string
+	// CertsDir, if not empty, overrides the default certs.d directories (with one subdirectory per registry host)
+	CertsDir string
+}
+
+// NewSystemContext returns a containers/image context to access registries
+func NewSystemContext(options RegistryOptions) (*types.SystemContext, error) {
+	result := &types.SystemContext{
+		AuthFilePath:             options.AuthFile,
+		DockerCertPath:           options.CertDir,
+		RegistriesDirPath:        options.RegistriesDir,
+		DockerPerHostCertDirPath: options.CertsDir,
+	}
+
+	if options.Creds != "" {
+		parts := strings.SplitN(options.Creds, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Credentials must be in USERNAME:PASSWORD format")
+		}
+		result.DockerAuthConfig = &types.DockerAuthConfig{Username: parts[0], Password: parts[1]}
+	}
+
+	if !options.TLSVerify {
+		result.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	return result, nil
+}
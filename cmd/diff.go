@@ -1,15 +1,17 @@
 package cmd
 
 import (
-	"bufio"
 	"context"
+	"crypto/ed25519"
+	"github.com/alitto/pond"
 	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
-	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
 	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
 	"github.com/moio/booster/util"
 	"github.com/moio/booster/wharf"
 	"github.com/opencontainers/go-digest"
@@ -18,55 +20,178 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-// Diff downloads two sets of images in tempDir and then
-// creates a wharf diff between them in patchPath
-func Diff(oldList string, newList string, tempDir string, patchPath string) error {
-	oldImages, err := readLines(oldList)
+// Diff downloads two sets of images in tempDir, accessing registries via srcCtx, and then
+// creates a booster patch between them in patchPath
+// images for platforms are selected from multi-platform images
+// signatures, attestations, SBOMs and OCI referrers of new images are included in the patch
+// if resume is true, work recorded in tempDir by a previous run is skipped
+// if verifyPatch is true, the patch is applied to a copy of the old images and the result is checked
+// if splitSize is positive, the patch is split into volumes of at most splitSize bytes, described by an index file
+// if signKey is not nil, a detached signature is written next to the patch (or its index)
+// if reportPath is not empty, a report with sizes, savings and timings is written there (see writeReport)
+// if gzipReconstruction is true, gzip layers from any encoder are decompressed along with reconstruction data
+func Diff(oldList string, newList string, tempDir string, patchPath string, boosterVersion string, srcCtx *types.SystemContext, platforms patch.PlatformSelection, downloadOptions DownloadOptions, resume bool, verifyPatch bool, splitSize int64, signKey ed25519.PrivateKey, reportPath string, gzipReconstruction bool) error {
+	timer := newPhaseTimer()
+	oldImages, err := readList(oldList)
 	if err != nil {
 		return err
 	}
-	newImages, err := readLines(newList)
+	newImages, err := readList(newList)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadDiffState(tempDir, resume, gzipReconstruction)
 	if err != nil {
 		return err
 	}
 
 	log.Info().Str("list", oldList).Msg("Processing")
 	imageTempDir := filepath.Join(tempDir, "images")
-	oldFiles, err := downloadAll(oldImages, imageTempDir)
+	oldFiles, oldDigests, err := downloadAll(oldImages, "", nil, srcCtx, platforms, downloadOptions, imageTempDir, state)
 	if err != nil {
 		return errors.Wrapf(err, "Error while computing diff")
 	}
+	if err := state.setPhase(phaseOldDownloaded); err != nil {
+		return err
+	}
+	timer.done(phaseOldDownloaded)
 
-	uncompressedOldFiles := gzip.Decompress(oldFiles)
+	uncompressedOldFiles, err := state.decompress(oldFiles)
+	if err != nil {
+		return err
+	}
+	if err := state.setPhase(phaseOldDecompressed); err != nil {
+		return err
+	}
+	timer.done(phaseOldDecompressed)
 
 	log.Info().Str("list", newList).Msg("Processing")
-	newFiles, err := downloadAll(newImages, imageTempDir)
+	newFiles, newDigests, err := downloadAll(newImages, "", nil, srcCtx, platforms, downloadOptions, imageTempDir, state)
 	if err != nil {
 		return errors.Wrapf(err, "Error while computing diff")
 	}
-	uncompressedNewFiles := gzip.Decompress(newFiles)
+	artifactFiles, artifacts, err := downloadArtifacts(newDigests, srcCtx, downloadOptions, imageTempDir)
+	if err != nil {
+		return errors.Wrapf(err, "Error while computing diff")
+	}
+	artifactFiles.Walk(newFiles.Add)
+	if err := state.setPhase(phaseNewDownloaded); err != nil {
+		return err
+	}
+	timer.done(phaseNewDownloaded)
+
+	uncompressedNewFiles, err := state.decompress(newFiles)
+	if err != nil {
+		return err
+	}
+	if err := state.setPhase(phaseNewDecompressed); err != nil {
+		return err
+	}
+	timer.done(phaseNewDecompressed)
 
 	allUncompressedFiles := util.Merge(uncompressedOldFiles, uncompressedNewFiles)
 	// add compulsory files from the OCI format
 	allUncompressedFiles.Add(path.Join(imageTempDir, "oci-layout"))
 	allUncompressedFiles.Add(path.Join(imageTempDir, "index.json"))
 
-	log.Info().Str("name", patchPath).Msg("Creating patch")
+	compression, quality := wharf.CompressionSettings()
+	header := &patch.Header{
+		BoosterVersion: boosterVersion,
+		OldImages:      oldDigests,
+		NewImages:      newDigests,
+		NewImagesSize:  newFiles.TotalFileSize(),
+		Settings:       patch.Settings{Compression: compression, Quality: quality, Platforms: platforms, GzipReconstruction: gzipReconstruction, DeflateEncoder: gzip.EncoderVersion},
+		Artifacts:      artifacts,
+	}
 
-	f, err := os.Create(patchPath)
-	if err != nil {
-		return errors.Wrap(err, "Error while opening patch file")
+	exists := state.patchExists(patchPath, header, splitSize)
+	if exists {
+		log.Info().Str("name", patchPath).Msg("Patch already created")
+	} else {
+		log.Info().Str("name", patchPath).Msg("Creating patch")
+		if err := createPatch(patchPath, header, imageTempDir, uncompressedOldFiles, allUncompressedFiles); err != nil {
+			return err
+		}
+	}
+	timer.done(phasePatchCreated)
+
+	// a patch split by a previous run is read via its index
+	readPath := patchPath
+	split := exists && fileSize(patchPath) < 0
+	if split {
+		readPath = patchPath + patch.IndexSuffix
+	}
+
+	if verifyPatch {
+		if err := verify(readPath, imageTempDir, uncompressedOldFiles, newDigests, filepath.Join(tempDir, "verify")); err != nil {
+			return err
+		}
+		timer.done(phaseVerified)
+	}
+
+	if !exists {
+		if err := state.patchCreated(patchPath, header); err != nil {
+			return err
+		}
 	}
-	oldFilter := wharf.NewFileSetFilter(uncompressedOldFiles)
-	newFilter := wharf.NewFileSetFilter(allUncompressedFiles)
-	err = wharf.CreatePatch(imageTempDir, oldFilter.Filter, imageTempDir, newFilter.Filter, util.PreventClosing(f))
+
+	// the patch size is computed before splitting, which replaces patchPath with volumes
+	wharfPatchSize, err := patchSize(readPath)
 	if err != nil {
-		log.Err(err).Msg("Error during patch creation")
+		return err
+	}
+
+	// patch contents are inspected before splitting
+	var info *wharf.PatchInfo
+	if reportPath != "" {
+		_, offset, err := readHeader(readPath)
+		if err != nil {
+			return err
+		}
+		info, err = inspectPatch(readPath, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	// split patches are signed via their index, which lists volume digests
+	signedPath := readPath
+	if splitSize > 0 && !split {
+		indexPath, err := patch.Split(patchPath, splitSize)
+		if err != nil {
+			return errors.Wrap(err, "Error while splitting patch")
+		}
+		if err := state.patchSplit(splitSize); err != nil {
+			return err
+		}
+		log.Info().Str("index", indexPath).Msg("Patch split into volumes")
+		signedPath = indexPath
+		timer.done(phaseSplit)
+	}
+
+	if signKey != nil {
+		signaturePath := signedPath + patch.SignatureSuffix
+		if err := patch.Sign(signedPath, signaturePath, signKey); err != nil {
+			return err
+		}
+		log.Info().Str("name", signaturePath).Str("key", patch.Fingerprint(signKey.Public().(ed25519.PublicKey))).Msg("Patch signed")
+		timer.done(phaseSigned)
 	}
-	if err := f.Close(); err != nil {
-		return errors.Wrap(err, "Error while closing patch file")
+
+	if reportPath != "" {
+		report, err := newReport(patchPath, header, wharfPatchSize, imageTempDir, oldFiles, uncompressedOldFiles, newFiles, uncompressedNewFiles, info, timer)
+		if err != nil {
+			return errors.Wrap(err, "Error while creating report")
+		}
+		if err := writeReport(report, reportPath); err != nil {
+			return err
+		}
+		log.Info().Str("name", reportPath).Msg("Report written")
 	}
 
 	oldSize := oldFiles.TotalFileSize()
@@ -74,7 +199,6 @@ func Diff(oldList string, newList string, tempDir string, patchPath string) erro
 	newSize := newFiles.TotalFileSize()
 	uncompressedNewSize := uncompressedNewFiles.TotalFileSize()
 	pushPullPatchSize := util.Minus(newFiles, oldFiles).TotalFileSize()
-	wharfPatchSize := util.NewFileSetWith(patchPath).TotalFileSize()
 	saving := (1 - (float32(wharfPatchSize) / float32(pushPullPatchSize))) * 100
 
 	log.Info().Msgf("All done!")
@@ -88,107 +212,233 @@ func Diff(oldList string, newList string, tempDir string, patchPath string) erro
 	return nil
 }
 
-// readLines reads a file and returns a list of strings, one per line
-func readLines(path string) ([]string, error) {
-	file, err := os.Open(path)
+// createPatch writes header and a wharf patch from oldFiles to newFiles (in imageDir) to patchPath
+// patchPath is removed in case of errors, along with any stale signature
+func createPatch(patchPath string, header *patch.Header, imageDir string, oldFiles *util.FileSet, newFiles *util.FileSet) error {
+	if err := os.Remove(patchPath + patch.SignatureSuffix); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Error while removing stale patch signature")
+	}
+
+	f, err := os.Create(patchPath)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error while reading file %v", path)
+		return errors.Wrap(err, "Error while opening patch file")
 	}
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	err = patch.WriteHeader(f, header)
+	if err == nil {
+		oldFilter := wharf.NewFileSetFilter(oldFiles)
+		newFilter := wharf.NewFileSetFilter(newFiles)
+		err = wharf.CreatePatch(imageDir, oldFilter.Filter, imageDir, newFilter.Filter, util.PreventClosing(f))
+		err = errors.Wrap(err, "Error during patch creation")
+	}
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "Error while closing patch file")
 	}
 
-	if err := file.Close(); err != nil {
-		return nil, errors.Wrapf(err, "Error while closing file %v", path)
+	if err != nil {
+		removeErr := os.Remove(patchPath)
+		if removeErr != nil {
+			log.Error().Str("name", patchPath).Err(removeErr).Msg("Error while removing incomplete patch")
+		}
+		return err
 	}
+	return nil
+}
 
-	return lines, nil
+// DownloadOptions configures image downloads
+type DownloadOptions struct {
+	// ParallelImages is the maximum number of images downloaded concurrently
+	ParallelImages int
+	// Retries is the number of times a failed image download is retried, with exponential backoff
+	Retries int
 }
 
-// downloadAll downloads all images into dir
-func downloadAll(images []string, dir string) (*util.FileSet, error) {
+// initialRetryDelay is the delay before the first retry of a failed download, doubled at every retry
+const initialRetryDelay = 2 * time.Second
+
+// tooManyRequestsRetryDelay is the minimum delay before retrying a download which failed with HTTP 429,
+// after the registry client exhausted its own retries (which honor the Retry-After header)
+const tooManyRequestsRetryDelay = 60 * time.Second
+
+// downloadAll downloads all images into dir, concurrently
+// images are looked up in registry (with rewrites applied to names), or in their own registry if registry is empty, via sys
+// images for platforms are selected from multi-platform images
+// if state is not nil, images it records are not downloaded again and downloaded images are recorded
+// returns downloaded files and image manifest digests, or an error listing all failed images
+func downloadAll(images []patch.Image, registry string, rewrites Rewrites, sys *types.SystemContext, platforms patch.PlatformSelection, options DownloadOptions, dir string, state *diffState) (*util.FileSet, []patch.Image, error) {
+	digests := make([]patch.Image, len(images))
+	files := make([][]string, len(images))
+	errs := make([]error, len(images))
+
+	pool := pond.New(options.ParallelImages, len(images))
+	for i, image := range images {
+		i, image := i, image
+		pool.Submit(func() {
+			if state != nil {
+				if d, cachedFiles, ok := state.cachedImage(image.Name, dir); ok {
+					image.Digest = d
+					digests[i] = image
+					files[i] = cachedFiles
+					return
+				}
+			}
+
+			image.Digest, files[i], errs[i] = downloadWithRetries(image, registry, rewrites, sys, platforms, options.Retries, dir)
+			digests[i] = image
+			if errs[i] == nil && state != nil {
+				errs[i] = state.imageDownloaded(image.Name, image.Digest)
+			}
+		})
+	}
+	pool.StopAndWait()
+
 	fileSet := util.NewFileSet()
-	for _, image := range images {
-		files, err := download(image, dir)
-		if err != nil {
-			return nil, err
+	failed := []string{}
+	for i, image := range images {
+		if errs[i] != nil {
+			log.Error().Str("image", image.Name).Err(errs[i]).Msg("Download failed")
+			failed = append(failed, image.Name)
+			continue
 		}
-		for _, file := range files {
+		for _, file := range files[i] {
 			fileSet.Add(file)
 		}
 	}
-	return fileSet, nil
+	if len(failed) > 0 {
+		return nil, nil, errors.Errorf("%v of %v images could not be downloaded: %v", len(failed), len(images), strings.Join(failed, ", "))
+	}
+
+	return fileSet, digests, nil
+}
+
+// downloadWithRetries calls download, retrying up to retries times with exponential backoff
+func downloadWithRetries(image patch.Image, registry string, rewrites Rewrites, sys *types.SystemContext, platforms patch.PlatformSelection, retries int, dir string) (digest.Digest, []string, error) {
+	delay := initialRetryDelay
+	for attempt := 0; ; attempt++ {
+		d, files, err := download(image, registry, rewrites, sys, platforms, dir)
+		if err == nil || attempt >= retries {
+			return d, files, err
+		}
+
+		wait := delay
+		if errors.Is(err, docker.ErrTooManyRequests) && wait < tooManyRequestsRetryDelay {
+			wait = tooManyRequestsRetryDelay
+		}
+		log.Warn().Str("image", image.Name).Err(err).Dur("wait", wait).Msg("Download failed, retrying")
+		time.Sleep(wait)
+		delay *= 2
+	}
 }
 
 // download downloads an image into dir
-// returns a map to files that have been downloaded
-func download(image string, dir string) ([]string, error) {
-	log.Info().Str("image", image).Msg("Downloading")
+// the image is looked up in registry (with rewrites applied to its name), or in its own registry if registry is empty, via sys
+// images for platforms are selected if the image is a multi-platform image
+// returns the manifest digest and a map to files that have been downloaded
+func download(image patch.Image, registry string, rewrites Rewrites, sys *types.SystemContext, platforms patch.PlatformSelection, dir string) (digest.Digest, []string, error) {
+	log.Info().Str("image", image.Name).Str("registry", registry).Msg("Downloading")
 
 	policy, err := signature.DefaultPolicy(nil)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image)
+		return "", nil, errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image.Name)
 	}
 	policyContext, err := signature.NewPolicyContext(policy)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image)
+		return "", nil, errors.Wrapf(err, "Error creating default policy context while copying the image: %v", image.Name)
 	}
 
 	// build reference to OCI directory export
-	destRef, err := layout.NewReference(dir, image)
+	name, err := imageName(image.Name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error parsing reference: %v", image)
+		return "", nil, err
 	}
-
-	// build reference to a container in a Docker registry
-	named, err := reference.ParseNormalizedNamed(image)
+	layoutRef, err := layout.NewReference(dir, name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error parsing reference: %v", image)
+		return "", nil, errors.Wrapf(err, "Error parsing reference: %v", image.Name)
 	}
-	srcRef, err := docker.NewReference(reference.TagNameOnly(named))
+	destRef := concurrentLayoutReference{layoutRef}
+
+	// build reference to the image source
+	srcRef, err := sourceReference(registry, image, rewrites)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error parsing reference: %v", image)
+		return "", nil, err
 	}
 
-	manifestBytes, err := copy.Image(context.Background(), policyContext, destRef, srcRef, &copy.Options{OptimizeDestinationImageAlreadyExists: true})
+	options := &copy.Options{SourceCtx: sys, OptimizeDestinationImageAlreadyExists: true}
+	if err := selectPlatforms(options, srcRef, sys, platforms); err != nil {
+		return "", nil, errors.Wrapf(err, "Error selecting platforms for image: %v", image.Name)
+	}
+
+	manifestBytes, err := copy.Image(context.Background(), policyContext, destRef, srcRef, options)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error copying image: %v", image)
+		return "", nil, errors.Wrapf(err, "Error copying image: %v", image.Name)
 	}
 
 	d, err := manifest.Digest(manifestBytes)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error computing digest for image: %v", image)
+		return "", nil, errors.Wrapf(err, "Error computing digest for image: %v", image.Name)
 	}
-	m, err := manifest.FromBlob(manifestBytes, manifest.GuessMIMEType(manifestBytes))
+	files, err := manifestFiles(manifestBytes, dir)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error parsing manifest of image: %v", image)
+		return "", nil, errors.Wrapf(err, "Error parsing manifest of image: %v", image.Name)
 	}
 
-	return manifestFiles(m, d, dir), nil
+	return d, files, nil
 }
 
 // manifestFiles returns the set of files corresponding to an image manifest
 // as per the "Open Container Image Layout Specification"
 // see https://github.com/opencontainers/image-spec/blob/v1.0.1/image-layout.md#content
-func manifestFiles(manifest manifest.Manifest, manifestDigest digest.Digest, basePath string) []string {
+// manifest lists and indexes are walked recursively, skipping child manifests not present in basePath
+func manifestFiles(manifestBytes []byte, basePath string) ([]string, error) {
 	result := []string{}
 	// manifest file
-	manifestPath := path.Join(basePath, "blobs", manifestDigest.Algorithm().String(), manifestDigest.Encoded())
-	result = append(result, manifestPath)
+	manifestDigest, err := manifest.Digest(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, blobPath(basePath, manifestDigest))
+
+	mimeType := manifest.GuessMIMEType(manifestBytes)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBytes, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		// child manifest files
+		for _, instanceDigest := range list.Instances() {
+			instanceBytes, err := os.ReadFile(blobPath(basePath, instanceDigest))
+			if os.IsNotExist(err) {
+				// platform was not selected
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			instanceFiles, err := manifestFiles(instanceBytes, basePath)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, instanceFiles...)
+		}
+		return result, nil
+	}
+
+	m, err := manifest.FromBlob(manifestBytes, mimeType)
+	if err != nil {
+		return nil, err
+	}
 
 	// configinfo file
-	configDigest := manifest.ConfigInfo().Digest
-	configPath := path.Join(basePath, "blobs", configDigest.Algorithm().String(), configDigest.Encoded())
-	result = append(result, configPath)
+	result = append(result, blobPath(basePath, m.ConfigInfo().Digest))
 
 	// layer files
-	for _, layerInfo := range manifest.LayerInfos() {
-		layerDigest := layerInfo.Digest
-		layerPath := path.Join(basePath, "blobs", layerDigest.Algorithm().String(), layerDigest.Encoded())
-		result = append(result, layerPath)
+	for _, layerInfo := range m.LayerInfos() {
+		result = append(result, blobPath(basePath, layerInfo.Digest))
 	}
-	return result
+	return result, nil
+}
+
+// blobPath returns the path of a blob in the OCI layout in basePath
+func blobPath(basePath string, d digest.Digest) string {
+	return path.Join(basePath, "blobs", d.Algorithm().String(), d.Encoded())
 }
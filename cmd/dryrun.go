@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
+	"github.com/moio/booster/util"
+	"github.com/moio/booster/wharf"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// printPlan prints what Apply would do with the patches at patchPaths, once old images are downloaded in imageDir
+// (as oldFiles) and checked against patch headers: references old images were read from, manifests and tags
+// new images would push to or overwrite in destination (accessed via destCtx), and estimates of the temporary
+// disk space and of the bytes to upload
+func printPlan(patchPaths []string, offsets []int64, headers []*patch.Header, imageDir string, oldFiles *util.FileSet, oldSource string, destination string, rewrites Rewrites, destCtx *types.SystemContext) error {
+	oldImages := headers[0].OldImages
+	newImages := headers[len(headers)-1].NewImages
+
+	fmt.Printf("Old images (read from, patch applies):\n")
+	for _, image := range oldImages {
+		ref, err := sourceReference(oldSource, image, rewrites)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  %v -> %v (%v)\n", image.Name, transports.ImageName(ref), image.Digest)
+	}
+
+	fmt.Printf("\nNew images (uploaded to):\n")
+	for _, image := range newImages {
+		ref, err := destinationReference(destination, image, rewrites)
+		if err != nil {
+			return err
+		}
+		current, found, err := currentDigest(ref, destCtx)
+		switch {
+		case err != nil && isUnauthorized(err):
+			return errors.Wrapf(err, "Not authorized to read current manifest of %v, check destination credentials", transports.ImageName(ref))
+		case err != nil:
+			return errors.Wrapf(err, "Error while reading current manifest of %v", transports.ImageName(ref))
+		case !found:
+			fmt.Printf("  push       %v -> %v (%v)\n", image.Name, transports.ImageName(ref), image.Digest)
+		case current == image.Digest:
+			fmt.Printf("  unchanged  %v -> %v (%v)\n", image.Name, transports.ImageName(ref), image.Digest)
+		default:
+			fmt.Printf("  overwrite  %v -> %v (%v, currently %v)\n", image.Name, transports.ImageName(ref), image.Digest, current)
+		}
+	}
+
+	if artifacts := headers[len(headers)-1].Artifacts; len(artifacts) > 0 {
+		fmt.Printf("\nArtifacts (uploaded to):\n")
+		for _, artifact := range artifacts {
+			ref, err := artifactDestinationReference(artifact, newImages, destination, rewrites)
+			if err != nil {
+				return err
+			}
+			if ref == nil {
+				fmt.Printf("  skipped    %v:%v (destination does not support tags)\n", artifact.Image, artifact.Tag)
+				continue
+			}
+			fmt.Printf("  %v -> %v (%v)\n", artifact.Image, transports.ImageName(ref), artifact.Digest)
+		}
+	}
+
+	diskSpace, uploadSize, err := estimateSizes(patchPaths, offsets, headers, imageDir, oldFiles)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nTemporary disk space: %5v MB (estimated)\n", diskSpace/1048576)
+	fmt.Printf("Upload size:          %5v MB (estimated, at most)\n", uploadSize/1048576)
+	return nil
+}
+
+// currentDigest returns the digest of the manifest currently at ref, accessed via sys, or false if there is none:
+// a manifest or repository unknown to a registry, or a missing OCI layout, directory, archive or image in a layout
+func currentDigest(ref types.ImageReference, sys *types.SystemContext) (digest.Digest, bool, error) {
+	if ref.Transport().Name() == layout.Transport.Name() {
+		// "path:name", as in destinationReference
+		parts := strings.SplitN(ref.StringWithinTransport(), ":", 2)
+		if len(parts) == 2 && parts[1] != "" {
+			found, err := layoutHasImage(parts[0], parts[1])
+			if err != nil || !found {
+				return "", false, err
+			}
+		}
+	}
+
+	ctx := context.Background()
+	source, err := ref.NewImageSource(ctx, sys)
+	if isNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer source.Close()
+
+	manifestBytes, _, err := source.GetManifest(ctx, nil)
+	if isNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	d, err := manifest.Digest(manifestBytes)
+	return d, err == nil, err
+}
+
+// isNotFound returns true if err means there is no manifest at a reference: a manifest or repository unknown
+// to a registry, or a missing directory or archive
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if os.IsNotExist(cause) {
+		return true
+	}
+	return hasErrorCode(cause, v2.ErrorCodeManifestUnknown, v2.ErrorCodeNameUnknown)
+}
+
+// isUnauthorized returns true if err means credentials were rejected by a registry, or do not allow access
+func isUnauthorized(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(docker.ErrUnauthorizedForCredentials); ok {
+		return true
+	}
+	return hasErrorCode(cause, errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied)
+}
+
+// hasErrorCode returns true if err is a registry error, or list of errors, with any of codes
+func hasErrorCode(err error, codes ...errcode.ErrorCode) bool {
+	var errs errcode.Errors
+	switch e := err.(type) {
+	case errcode.Errors:
+		errs = e
+	case errcode.Error:
+		errs = errcode.Errors{e}
+	}
+	for _, e := range errs {
+		registryErr, ok := e.(errcode.Error)
+		if !ok {
+			continue
+		}
+		for _, code := range codes {
+			if registryErr.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOldFiles returns an error if files the patch at patchPath applies to, as listed in its wharf patch stream
+// starting at offset, are missing from uncompressedOldFiles in imageDir or have a different size
+func checkOldFiles(patchPath string, offset int64, imageDir string, uncompressedOldFiles *util.FileSet) error {
+	info, err := inspectPatch(patchPath, offset)
+	if err != nil {
+		return err
+	}
+
+	mismatches := []string{}
+	for _, f := range info.OldContainer.Files {
+		p := filepath.Join(imageDir, f.Path)
+		if !uncompressedOldFiles.Present(p) {
+			log.Error().Str("file", f.Path).Msg("Not found among old image files")
+			mismatches = append(mismatches, f.Path)
+			continue
+		}
+		if size := fileSize(p); size != f.Size {
+			log.Error().Str("file", f.Path).Int64("expected_size", f.Size).Int64("size", size).Msg("Size differs from old image file")
+			mismatches = append(mismatches, f.Path)
+		}
+	}
+	if len(mismatches) > 0 {
+		return errors.Errorf("%v files are missing or differ: %v", len(mismatches), strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// estimateSizes returns estimates of the temporary disk space needed to apply the patches at patchPaths
+// to oldFiles in imageDir, and of the bytes to upload to a destination which already has old images
+// disk space accounts for downloaded files, decompressed layers, files written by patches and recompressed layers
+func estimateSizes(patchPaths []string, offsets []int64, headers []*patch.Header, imageDir string, oldFiles *util.FileSet) (int64, int64, error) {
+	diskSpace := oldFiles.TotalFileSize()
+	var newContainerFiles []string
+	for i, patchPath := range patchPaths {
+		info, err := inspectPatch(patchPath, offsets[i])
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == 0 {
+			for _, f := range info.OldContainer.Files {
+				if gzip.IsDecompressed(f.Path) {
+					diskSpace += f.Size
+				}
+			}
+		}
+		for _, f := range info.Files {
+			if f.Status != wharf.Reused {
+				diskSpace += f.Size
+			}
+		}
+		newContainerFiles = newContainerFiles[:0]
+		for _, f := range info.NewContainer.Files {
+			newContainerFiles = append(newContainerFiles, f.Path)
+		}
+	}
+
+	// new files already among old ones (eg. unchanged layers) are not uploaded again
+	var reusedSize int64
+	for _, p := range newContainerFiles {
+		compressedPath := filepath.Join(imageDir, gzip.CompressedPath(p))
+		if !oldFiles.Present(compressedPath) {
+			continue
+		}
+		info, err := os.Stat(compressedPath)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "Error while reading %v", compressedPath)
+		}
+		reusedSize += info.Size()
+	}
+	uploadSize := headers[len(headers)-1].NewImagesSize - reusedSize
+	if uploadSize < 0 {
+		uploadSize = 0
+	}
+
+	// recompressed layers take about as much space as uploaded ones
+	return diskSpace + uploadSize, uploadSize, nil
+}
+
+// inspectPatch inspects the wharf patch stream, starting at offset, of the patch at patchPath
+func inspectPatch(patchPath string, offset int64) (*wharf.PatchInfo, error) {
+	f, err := patch.Open(patchPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := wharf.Inspect(f, f.Size(), offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while inspecting patch %v", patchPath)
+	}
+	return info, nil
+}
+
+// patchSize returns the total size of the patch at patchPath, which can also be the index or first volume of a split patch
+func patchSize(patchPath string) (int64, error) {
+	f, err := patch.Open(patchPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Size(), nil
+}
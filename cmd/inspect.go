@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
+	"github.com/moio/booster/util"
+	"github.com/pkg/errors"
+)
+
+// File kinds in an inspection
+const (
+	kindManifest = "manifest"
+	kindLayer    = "layer"
+	kindBlob     = "blob"
+	kindMetadata = "metadata"
+)
+
+// Inspection describes a patch file
+type Inspection struct {
+	BoosterVersion string
+	Settings       patch.Settings
+	OldImages      []patch.Image
+	NewImages      []patch.Image
+	// OldSize is the total size of (decompressed) files the patch applies to
+	OldSize int64
+	// NewSize is the total size of (decompressed) files the patch produces
+	NewSize int64
+	// PatchSize is the size of the patch file
+	PatchSize int64
+	// ExpectedSize is the total size of new image files after recompression
+	ExpectedSize int64
+	Files        []InspectedFile
+}
+
+// InspectedFile describes how a patch produces a file
+type InspectedFile struct {
+	Path string
+	// Kind is one of manifest, layer, blob or metadata
+	Kind string
+	// Status is one of added, modified or reused
+	Status string
+	Size   int64
+	// OperationSize is the (approximate) number of compressed patch bytes for this file
+	OperationSize int64
+}
+
+// Inspect prints a description of the patch at patchPath to standard output,
+// in text or json format
+func Inspect(patchPath string, format string) error {
+	if format != "text" && format != "json" {
+		return errors.Errorf("Unsupported format %v, expected text or json", format)
+	}
+
+	header, offset, err := readHeader(patchPath)
+	if err != nil {
+		return err
+	}
+
+	info, err := inspectPatch(patchPath, offset)
+	if err != nil {
+		return err
+	}
+
+	size, err := patchSize(patchPath)
+	if err != nil {
+		return err
+	}
+
+	manifests := util.NewFileSet()
+	for _, image := range append(header.OldImages, header.NewImages...) {
+		manifests.Add(path.Join("blobs", image.Digest.Algorithm().String(), image.Digest.Encoded()))
+	}
+
+	inspection := Inspection{
+		BoosterVersion: header.BoosterVersion,
+		Settings:       header.Settings,
+		OldImages:      header.OldImages,
+		NewImages:      header.NewImages,
+		OldSize:        info.OldContainer.Size,
+		NewSize:        info.NewContainer.Size,
+		PatchSize:      size,
+		ExpectedSize:   header.NewImagesSize,
+		Files:          []InspectedFile{},
+	}
+	for _, f := range info.Files {
+		kind := kindBlob
+		switch {
+		case manifests.Present(f.Path):
+			kind = kindManifest
+		case gzip.IsDecompressed(f.Path):
+			kind = kindLayer
+		case gzip.IsSidecar(f.Path):
+			kind = kindMetadata
+		case !strings.HasPrefix(f.Path, "blobs/"):
+			kind = kindMetadata
+		}
+		inspection.Files = append(inspection.Files, InspectedFile{
+			Path:          f.Path,
+			Kind:          kind,
+			Status:        f.Status,
+			Size:          f.Size,
+			OperationSize: f.OperationSize,
+		})
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(inspection)
+	}
+
+	printInspection(&inspection)
+	return nil
+}
+
+// printImage prints an image of an Inspection, with its destination if any
+func printImage(image patch.Image) {
+	if image.Destination != "" {
+		fmt.Printf("  %v (%v) -> %v\n", image.Name, image.Digest, image.Destination)
+		return
+	}
+	fmt.Printf("  %v (%v)\n", image.Name, image.Digest)
+}
+
+// printInspection prints an Inspection in human-readable form
+func printInspection(i *Inspection) {
+	fmt.Printf("Booster version: %v\n", i.BoosterVersion)
+	fmt.Printf("Compression:     %v (quality %v)\n", i.Settings.Compression, i.Settings.Quality)
+	if i.Settings.DeflateEncoder != "" {
+		fmt.Printf("Encoders:        %v\n", i.Settings.DeflateEncoder)
+	}
+	fmt.Printf("\nOld images (source):\n")
+	for _, image := range i.OldImages {
+		printImage(image)
+	}
+	fmt.Printf("\nNew images (target):\n")
+	for _, image := range i.NewImages {
+		printImage(image)
+	}
+
+	fmt.Printf("\nFiles:\n")
+	fmt.Printf("  %-8s  %-8s  %12s  %12s  %v\n", "STATUS", "KIND", "SIZE", "PATCH BYTES", "PATH")
+	for _, f := range i.Files {
+		fmt.Printf("  %-8s  %-8s  %12d  %12d  %v\n", f.Status, f.Kind, f.Size, f.OperationSize, f.Path)
+	}
+
+	fmt.Printf("\nOld files:      %5v MB (uncompressed)\n", i.OldSize/1048576)
+	fmt.Printf("New files:      %5v MB (uncompressed)\n", i.NewSize/1048576)
+	fmt.Printf("New images:     %5v MB (after recompression)\n", i.ExpectedSize/1048576)
+	fmt.Printf("Patch size:     %5v MB\n", i.PatchSize/1048576)
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// layoutIndexMutex serializes updates to OCI layout index.json files
+var layoutIndexMutex sync.Mutex
+
+// concurrentLayoutReference is an OCI layout reference that can be written to concurrently with
+// other concurrentLayoutReferences to the same layout.
+// containers/image's OCI layout destination reads index.json when created and overwrites it on
+// Commit, losing entries committed by concurrent copies in the meantime
+type concurrentLayoutReference struct {
+	types.ImageReference
+}
+
+// NewImageDestination implements types.ImageReference
+// index.json is read while holding layoutIndexMutex, so that it is not read while a concurrent Commit rewrites it
+func (r concurrentLayoutReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	layoutIndexMutex.Lock()
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	layoutIndexMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &concurrentLayoutDestination{ImageDestination: dest, ref: r.ImageReference, sys: sys}, nil
+}
+
+// putManifestCall records arguments of a PutManifest call
+type putManifestCall struct {
+	manifest       []byte
+	instanceDigest *digest.Digest
+}
+
+// concurrentLayoutDestination is a types.ImageDestination which, on Commit, replays manifests on an
+// up-to-date destination while holding layoutIndexMutex
+type concurrentLayoutDestination struct {
+	types.ImageDestination
+	ref   types.ImageReference
+	sys   *types.SystemContext
+	calls []putManifestCall
+}
+
+// PutManifest implements types.ImageDestination
+func (d *concurrentLayoutDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	d.calls = append(d.calls, putManifestCall{manifest: manifest, instanceDigest: instanceDigest})
+	return d.ImageDestination.PutManifest(ctx, manifest, instanceDigest)
+}
+
+// Commit implements types.ImageDestination
+func (d *concurrentLayoutDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	layoutIndexMutex.Lock()
+	defer layoutIndexMutex.Unlock()
+
+	// a new destination reads the current index.json
+	fresh, err := d.ref.NewImageDestination(ctx, d.sys)
+	if err != nil {
+		return err
+	}
+	defer fresh.Close()
+
+	for _, call := range d.calls {
+		if err := fresh.PutManifest(ctx, call.manifest, call.instanceDigest); err != nil {
+			return err
+		}
+	}
+	return fresh.Commit(ctx, unparsedToplevel)
+}
+
+// layoutRefNameAnnotation is the annotation of index.json entries with image names in OCI layouts
+const layoutRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// layoutIndex is the part of an OCI layout index.json listing image names
+type layoutIndex struct {
+	Manifests []struct {
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// layoutHasImage returns true if the OCI layout in dir has an image named name
+// returns false if there is no layout in dir
+func layoutHasImage(dir string, name string) (bool, error) {
+	layoutIndexMutex.Lock()
+	bytes, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	layoutIndexMutex.Unlock()
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "Error while reading OCI layout index in %v", dir)
+	}
+	var index layoutIndex
+	if err := json.Unmarshal(bytes, &index); err != nil {
+		return false, errors.Wrapf(err, "Error while parsing OCI layout index in %v", dir)
+	}
+	for _, m := range index.Manifests {
+		if m.Annotations[layoutRefNameAnnotation] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/moio/booster/patch"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// readList reads an image list file. Files with a .yaml or .yml extension are in YAML format:
+//
+//	images:
+//	  - ubuntu:bionic-20210702
+//	  - image: rancher/rancher:v2.5.9@sha256:...
+//	    destination: mirror/rancher
+//
+// otherwise files are in plain text format, with one "IMAGE [DESTINATION]" entry per line.
+// Blank lines and comments (starting with #) are ignored
+func readList(path string) ([]patch.Image, error) {
+	var images []patch.Image
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		images, err = readYAMLList(path)
+	default:
+		images, err = readTextList(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images {
+		if image.Name == "" {
+			return nil, errors.Errorf("Error in list %v: entry without image", path)
+		}
+		if image.Destination != "" {
+			if _, err := reference.ParseNormalizedNamed(image.Destination); err != nil {
+				return nil, errors.Wrapf(err, "Error in list %v: invalid destination for %v", path, image.Name)
+			}
+		}
+	}
+	return images, nil
+}
+
+// readTextList reads an image list file in plain text format
+func readTextList(path string) ([]patch.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while reading file %v", path)
+	}
+
+	images := []patch.Image{}
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			images = append(images, patch.Image{Name: fields[0]})
+		case 2:
+			images = append(images, patch.Image{Name: fields[0], Destination: fields[1]})
+		default:
+			file.Close()
+			return nil, errors.Errorf("Error in list %v, line %v: expected IMAGE [DESTINATION]", path, number)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "Error while reading file %v", path)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, errors.Wrapf(err, "Error while closing file %v", path)
+	}
+
+	return images, nil
+}
+
+// stripComment removes a comment, starting with # at the beginning of line or after whitespace
+func stripComment(line string) string {
+	for i, c := range line {
+		if c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlList is an image list in YAML format
+type yamlList struct {
+	Images []yamlEntry `yaml:"images"`
+}
+
+// yamlEntry is an entry of an image list in YAML format, either an image name or an image/destination map
+type yamlEntry patch.Image
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (e *yamlEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*e = yamlEntry{Name: name}
+		return nil
+	}
+
+	var entry struct {
+		Image       string `yaml:"image"`
+		Destination string `yaml:"destination"`
+	}
+	if err := unmarshal(&entry); err != nil {
+		return err
+	}
+	*e = yamlEntry{Name: entry.Image, Destination: entry.Destination}
+	return nil
+}
+
+// readYAMLList reads an image list file in YAML format
+func readYAMLList(path string) ([]patch.Image, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while reading file %v", path)
+	}
+
+	var list yamlList
+	if err := yaml.UnmarshalStrict(bytes, &list); err != nil {
+		return nil, errors.Wrapf(err, "Error in list %v", path)
+	}
+
+	images := []patch.Image{}
+	for _, entry := range list.Images {
+		images = append(images, patch.Image(entry))
+	}
+	return images, nil
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/moio/booster/patch"
+)
+
+// sha256Hex is a valid sha256 digest, in hex
+const sha256Hex = "0a18b2c6ee56e73ff13bedf235b0897008827518626da10cf3a071941c651b2a"
+
+func TestStripComment(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"", ""},
+		{"ubuntu:20.04", "ubuntu:20.04"},
+		{"# a comment", ""},
+		{"#a comment", ""},
+		{"ubuntu:20.04 # a comment", "ubuntu:20.04 "},
+		{"ubuntu:20.04\t# a comment", "ubuntu:20.04\t"},
+		{"ubuntu:20.04#not-a-comment", "ubuntu:20.04#not-a-comment"},
+		{"oci:/layouts/build#2:app # a comment", "oci:/layouts/build#2:app "},
+		{"  # indented comment", "  "},
+	}
+
+	for _, c := range cases {
+		if actual := stripComment(c.line); actual != c.expected {
+			t.Errorf("stripComment(%q) = %q, expected %q", c.line, actual, c.expected)
+		}
+	}
+}
+
+func TestReadList(t *testing.T) {
+	cases := []struct {
+		name     string
+		fileName string
+		contents string
+		expected []patch.Image
+		// err is true if the list is invalid
+		err bool
+	}{
+		{"images", "list.txt", "ubuntu:20.04\nrancher/rancher:v2.5.9\n", []patch.Image{{Name: "ubuntu:20.04"}, {Name: "rancher/rancher:v2.5.9"}}, false},
+		{"comments and blank lines", "list.txt", "# images\n\nubuntu:20.04 # LTS\n\n   \n# end\n", []patch.Image{{Name: "ubuntu:20.04"}}, false},
+		{"whitespace", "list.txt", "  ubuntu:20.04\t\n\tbusybox   mirror/busybox  \r\n", []patch.Image{{Name: "ubuntu:20.04"}, {Name: "busybox", Destination: "mirror/busybox"}}, false},
+		{"# inside a reference", "list.txt", "oci:/layouts/build#2:app\n", []patch.Image{{Name: "oci:/layouts/build#2:app"}}, false},
+		{"digest-pinned reference", "list.txt", "ubuntu:20.04@sha256:" + sha256Hex + "\n", []patch.Image{{Name: "ubuntu:20.04@sha256:" + sha256Hex}}, false},
+		{"destination", "list.txt", "ubuntu:20.04 mirror.example.com:5000/ubuntu\n", []patch.Image{{Name: "ubuntu:20.04", Destination: "mirror.example.com:5000/ubuntu"}}, false},
+		{"empty list", "list.txt", "# nothing\n", []patch.Image{}, false},
+		{"too many fields", "list.txt", "ubuntu:20.04 mirror/ubuntu extra\n", nil, true},
+		{"invalid destination", "list.txt", "ubuntu:20.04 Mirror/Ubuntu\n", nil, true},
+		{"YAML", "list.yaml", "images:\n  # comment\n  - ubuntu:20.04\n  - image: busybox\n    destination: mirror/busybox\n",
+			[]patch.Image{{Name: "ubuntu:20.04"}, {Name: "busybox", Destination: "mirror/busybox"}}, false},
+		{"YAML, .yml extension", "list.yml", "images:\n  - ubuntu:20.04\n", []patch.Image{{Name: "ubuntu:20.04"}}, false},
+		{"YAML entry without image", "list.yaml", "images:\n  - destination: mirror/busybox\n", nil, true},
+		{"YAML unknown field", "list.yaml", "images:\n  - image: busybox\n    destinaton: mirror/busybox\n", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), c.fileName)
+			if err := os.WriteFile(path, []byte(c.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			images, err := readList(path)
+			if c.err {
+				if err == nil {
+					t.Fatalf("invalid list read as %v", images)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(images, c.expected) {
+				t.Fatalf("read %v, expected %v", images, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/moio/booster/patch"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ValidatePlatforms returns an error if any platform is not in os/arch[/variant] format
+func ValidatePlatforms(platforms []string) error {
+	for _, platform := range platforms {
+		if _, err := platformContext(platform, &types.SystemContext{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// samePlatforms returns true if a and b select the same platforms, listed in any order
+func samePlatforms(a patch.PlatformSelection, b patch.PlatformSelection) bool {
+	if a.All || b.All {
+		return a.All == b.All
+	}
+	if len(a.Platforms) != len(b.Platforms) {
+		return false
+	}
+	sortedA := append([]string{}, a.Platforms...)
+	sortedB := append([]string{}, b.Platforms...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// platformContext returns a copy of sys selecting platform, in os/arch[/variant] format
+func platformContext(platform string, sys *types.SystemContext) (*types.SystemContext, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("Invalid platform %v, expected os/arch[/variant]", platform)
+	}
+
+	result := *sys
+	result.OSChoice = parts[0]
+	result.ArchitectureChoice = parts[1]
+	if len(parts) == 3 {
+		result.VariantChoice = parts[2]
+	}
+	return &result, nil
+}
+
+// selectPlatforms sets options to copy images for platforms, in case ref is a multi-platform image
+// if platforms is empty, options are left unchanged (only the host platform image is copied)
+func selectPlatforms(options *copy.Options, ref types.ImageReference, sys *types.SystemContext, platforms patch.PlatformSelection) error {
+	if platforms.All {
+		options.ImageListSelection = copy.CopyAllImages
+		return nil
+	}
+	if len(platforms.Platforms) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	manifestBytes, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		// single-platform image, nothing to select
+		return nil
+	}
+	list, err := manifest.ListFromBlob(manifestBytes, mimeType)
+	if err != nil {
+		return err
+	}
+
+	instances := []digest.Digest{}
+	for _, platform := range platforms.Platforms {
+		platformCtx, err := platformContext(platform, sys)
+		if err != nil {
+			return err
+		}
+		instance, err := list.ChooseInstance(platformCtx)
+		if err != nil {
+			return errors.Wrapf(err, "No image for platform %v", platform)
+		}
+		instances = append(instances, instance)
+	}
+
+	options.ImageListSelection = copy.CopySpecificImages
+	options.Instances = instances
+	return nil
+}
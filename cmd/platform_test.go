@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/moio/booster/patch"
+)
+
+func TestSamePlatforms(t *testing.T) {
+	amd64 := "linux/amd64"
+	arm64 := "linux/arm64/v8"
+	cases := []struct {
+		name     string
+		a        patch.PlatformSelection
+		b        patch.PlatformSelection
+		expected bool
+	}{
+		{"host platform", patch.PlatformSelection{}, patch.PlatformSelection{}, true},
+		{"all platforms", patch.PlatformSelection{All: true}, patch.PlatformSelection{All: true}, true},
+		{"same platforms", patch.PlatformSelection{Platforms: []string{amd64, arm64}}, patch.PlatformSelection{Platforms: []string{amd64, arm64}}, true},
+		{"same platforms, different order", patch.PlatformSelection{Platforms: []string{amd64, arm64}}, patch.PlatformSelection{Platforms: []string{arm64, amd64}}, true},
+		{"host platform and all platforms", patch.PlatformSelection{}, patch.PlatformSelection{All: true}, false},
+		{"host platform and one platform", patch.PlatformSelection{}, patch.PlatformSelection{Platforms: []string{amd64}}, false},
+		{"different platforms", patch.PlatformSelection{Platforms: []string{amd64}}, patch.PlatformSelection{Platforms: []string{arm64}}, false},
+		{"one more platform", patch.PlatformSelection{Platforms: []string{amd64}}, patch.PlatformSelection{Platforms: []string{amd64, arm64}}, false},
+	}
+
+	for _, c := range cases {
+		if actual := samePlatforms(c.a, c.b); actual != c.expected {
+			t.Errorf("%v: samePlatforms is %v, expected %v", c.name, actual, c.expected)
+		}
+		if actual := samePlatforms(c.b, c.a); actual != c.expected {
+			t.Errorf("%v, swapped: samePlatforms is %v, expected %v", c.name, actual, c.expected)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/moio/booster/patch"
+	"github.com/pkg/errors"
+)
+
+// dockerPrefix is the prefix of explicit references to images in Docker registries
+const dockerPrefix = "docker://"
+
+// hasTransport returns true if s starts with a transport prefix known to containers/image (eg. "oci:", "dir:")
+func hasTransport(s string) bool {
+	return alltransports.TransportFromImageName(s) != nil
+}
+
+// imageName returns the name of an image list entry in the temporary OCI layout and in destinations.
+// Entries without a transport prefix are plain Docker references and are returned unchanged
+func imageName(image string) (string, error) {
+	if !hasTransport(image) {
+		return image, nil
+	}
+	if strings.HasPrefix(image, dockerPrefix) {
+		return strings.TrimPrefix(image, dockerPrefix), nil
+	}
+
+	ref, err := alltransports.ParseImageName(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing reference: %v", image)
+	}
+	if named := ref.DockerReference(); named != nil {
+		return reference.FamiliarString(named), nil
+	}
+
+	// no Docker reference available, derive a name from the last path element
+	// eg. "dir:/exports/ubuntu" -> "ubuntu", "oci:/layouts/images:ubuntu:18.04" -> "ubuntu:18.04"
+	base := filepath.Base(ref.StringWithinTransport())
+	if parts := strings.SplitN(base, ":", 2); len(parts) == 2 && parts[1] != "" {
+		base = parts[1]
+	} else {
+		base = strings.TrimSuffix(parts[0], filepath.Ext(parts[0]))
+	}
+	name := strings.ToLower(base)
+	if _, err := reference.ParseNormalizedNamed(name); err != nil {
+		return "", errors.Wrapf(err, "Cannot derive an image name from %v", image)
+	}
+	return name, nil
+}
+
+// destinationName returns the name of an image list entry in destinations: its own destination, if any,
+// otherwise its name. Destinations without a tag or digest inherit them from the name.
+// Images pinned by both tag and digest are pushed by tag. rewrites are applied last
+func destinationName(image patch.Image, rewrites Rewrites) (string, error) {
+	name, err := imageName(image.Name)
+	if err != nil {
+		return "", err
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing reference: %v", name)
+	}
+	tagged, isTagged := named.(reference.NamedTagged)
+	digested, isDigested := named.(reference.Digested)
+
+	if image.Destination == "" {
+		if isTagged && isDigested {
+			name = strings.TrimSuffix(name, "@"+digested.Digest().String())
+		}
+		return rewrites.Apply(name), nil
+	}
+
+	destination, err := reference.ParseNormalizedNamed(image.Destination)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing destination: %v", image.Destination)
+	}
+	result := image.Destination
+	if reference.IsNameOnly(destination) {
+		if isTagged {
+			result += ":" + tagged.Tag()
+		} else if isDigested {
+			result += "@" + digested.Digest().String()
+		}
+	}
+	return rewrites.Apply(result), nil
+}
+
+// sourceReference returns a reference to read an image list entry from
+// if registry is not empty, the image is read from there, as written by destinationReference with rewrites
+func sourceReference(registry string, image patch.Image, rewrites Rewrites) (types.ImageReference, error) {
+	if registry != "" {
+		return destinationReference(registry, image, rewrites)
+	}
+	if hasTransport(image.Name) {
+		ref, err := alltransports.ParseImageName(image.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing reference: %v", image.Name)
+		}
+		return ref, nil
+	}
+	return registryReference("", image.Name)
+}
+
+// destinationReference returns a reference to write an image list entry to destination
+// destination is either a registry or a transport-prefixed location (eg. "oci:/media/images")
+// rewrites are applied to the image name
+func destinationReference(destination string, image patch.Image, rewrites Rewrites) (types.ImageReference, error) {
+	name, err := destinationName(image, rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasTransport(destination) || strings.HasPrefix(destination, dockerPrefix) {
+		return registryReference(strings.TrimPrefix(destination, dockerPrefix), name)
+	}
+
+	var refString string
+	if strings.HasPrefix(destination, "dir:") {
+		// one directory per image
+		sanitized := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(name)
+		refString = "dir:" + filepath.Join(strings.TrimPrefix(destination, "dir:"), sanitized)
+	} else {
+		// oci:, oci-archive:, docker-archive: and others accept a path:name syntax
+		refString = destination + ":" + name
+	}
+	ref, err := alltransports.ParseImageName(refString)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing reference: %v", refString)
+	}
+	return ref, nil
+}
+
+// registryReference returns a reference to image in a Docker registry
+// if registry is not empty, image is prefixed with it
+// images pinned by both tag and digest are referenced by digest
+func registryReference(registry string, image string) (types.ImageReference, error) {
+	name := image
+	if registry != "" {
+		name = registry + "/" + image
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing reference: %v", name)
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		named, err = reference.WithDigest(reference.TrimNamed(named), digested.Digest())
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing reference: %v", name)
+		}
+	}
+	ref, err := docker.NewReference(reference.TagNameOnly(named))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing reference: %v", name)
+	}
+	return ref, nil
+}
@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
+	"github.com/moio/booster/util"
+	"github.com/moio/booster/wharf"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Diff phases only recorded in reports, following those in diffState
+const (
+	phaseVerified = "verified"
+	phaseSplit    = "split"
+	phaseSigned   = "signed"
+)
+
+// Report describes a patch created by Diff, comparing it to a push and pull update
+type Report struct {
+	BoosterVersion string
+	Patch          string
+	// OldSize and NewSize are the total sizes of image files, Uncompressed* after layer decompression
+	OldSize             int64
+	UncompressedOldSize int64
+	NewSize             int64
+	UncompressedNewSize int64
+	// PushPullSize is the total size of new image files not in old images
+	PushPullSize int64
+	// PatchSize is the size of the patch file, before splitting
+	PatchSize int64
+	// Saving is the percentage of PushPullSize saved by the patch
+	Saving    float64
+	OldImages []ImageReport
+	NewImages []ImageReport
+	Phases    []PhaseReport
+}
+
+// ImageReport describes an image in a Report
+type ImageReport struct {
+	Name             string
+	Digest           digest.Digest
+	Size             int64
+	UncompressedSize int64
+	// PushPullSize is the total size of image files not in old images (new images only)
+	PushPullSize int64
+	// PatchSize is the (approximate) number of patch bytes producing image files (new images only)
+	PatchSize int64
+	Layers    []LayerReport
+}
+
+// LayerReport describes a layer in a Report
+type LayerReport struct {
+	Digest           digest.Digest
+	Size             int64
+	UncompressedSize int64
+	// Status is one of added, modified or reused (new images only)
+	Status string `json:",omitempty"`
+	// PatchSize is the (approximate) number of patch bytes producing the layer (new images only)
+	PatchSize int64
+}
+
+// PhaseReport records how long a Diff phase took
+type PhaseReport struct {
+	Name    string
+	Seconds float64
+}
+
+// phaseTimer measures durations of consecutive phases
+type phaseTimer struct {
+	last   time.Time
+	phases []PhaseReport
+}
+
+// newPhaseTimer returns a phaseTimer, with the first phase starting now
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{last: time.Now()}
+}
+
+// done records that a phase ended, having started when the previous one ended
+func (t *phaseTimer) done(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, PhaseReport{Name: name, Seconds: now.Sub(t.last).Seconds()})
+	t.last = now
+}
+
+// newReport returns a Report for a patch between oldFiles and newFiles, decompressed in uncompressedOldFiles and
+// uncompressedNewFiles, for images described by header in imageDir. info describes the patch wharf stream
+func newReport(patchPath string, header *patch.Header, patchSize int64, imageDir string, oldFiles *util.FileSet, uncompressedOldFiles *util.FileSet, newFiles *util.FileSet, uncompressedNewFiles *util.FileSet, info *wharf.PatchInfo, timer *phaseTimer) (*Report, error) {
+	report := &Report{
+		BoosterVersion:      header.BoosterVersion,
+		Patch:               patchPath,
+		OldSize:             oldFiles.TotalFileSize(),
+		UncompressedOldSize: uncompressedOldFiles.TotalFileSize(),
+		NewSize:             newFiles.TotalFileSize(),
+		UncompressedNewSize: uncompressedNewFiles.TotalFileSize(),
+		PushPullSize:        util.Minus(newFiles, oldFiles).TotalFileSize(),
+		PatchSize:           patchSize,
+		Phases:              timer.phases,
+	}
+	if report.PushPullSize > 0 {
+		report.Saving = (1 - float64(patchSize)/float64(report.PushPullSize)) * 100
+	}
+
+	files := map[string]wharf.FileInfo{}
+	for _, f := range info.Files {
+		files[filepath.Join(imageDir, f.Path)] = f
+	}
+
+	for _, image := range header.OldImages {
+		imageReport, err := newImageReport(image, imageDir, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		report.OldImages = append(report.OldImages, *imageReport)
+	}
+	for _, image := range header.NewImages {
+		imageReport, err := newImageReport(image, imageDir, oldFiles, files)
+		if err != nil {
+			return nil, err
+		}
+		report.NewImages = append(report.NewImages, *imageReport)
+	}
+	return report, nil
+}
+
+// newImageReport returns an ImageReport for an image in imageDir
+// for new images, oldFiles and patchFiles (by path in imageDir) are used to compute update and patch sizes
+func newImageReport(image patch.Image, imageDir string, oldFiles *util.FileSet, patchFiles map[string]wharf.FileInfo) (*ImageReport, error) {
+	manifestBytes, err := os.ReadFile(blobPath(imageDir, image.Digest))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while reading manifest of image %v", image.Name)
+	}
+	files, err := manifestFiles(manifestBytes, imageDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while parsing manifest of image %v", image.Name)
+	}
+	layers, err := manifestLayers(manifestBytes, imageDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while parsing manifest of image %v", image.Name)
+	}
+
+	result := &ImageReport{Name: image.Name, Digest: image.Digest, Layers: []LayerReport{}}
+	for _, file := range files {
+		size, uncompressedSize, err := fileSizes(file)
+		if err != nil {
+			return nil, err
+		}
+		result.Size += size
+		result.UncompressedSize += uncompressedSize
+		if oldFiles != nil {
+			if !oldFiles.Present(file) {
+				result.PushPullSize += size
+			}
+			result.PatchSize += patchFileInfo(patchFiles, file).OperationSize
+		}
+	}
+
+	for _, layer := range layers {
+		file := blobPath(imageDir, layer)
+		size, uncompressedSize, err := fileSizes(file)
+		if err != nil {
+			return nil, err
+		}
+		layerReport := LayerReport{Digest: layer, Size: size, UncompressedSize: uncompressedSize}
+		if oldFiles != nil {
+			f := patchFileInfo(patchFiles, file)
+			layerReport.Status = f.Status
+			layerReport.PatchSize = f.OperationSize
+		}
+		result.Layers = append(result.Layers, layerReport)
+	}
+	return result, nil
+}
+
+// fileSizes returns the size of an image file and its size after decompression, if it was decompressed
+func fileSizes(file string) (int64, int64, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "Error while reading %v", file)
+	}
+	for _, p := range gzip.DecompressedPaths(file) {
+		uncompressedInfo, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "Error while reading %v", p)
+		}
+		return info.Size(), uncompressedInfo.Size(), nil
+	}
+	return info.Size(), info.Size(), nil
+}
+
+// patchFileInfo returns how the patch produces an image file, in decompressed form if it was decompressed
+func patchFileInfo(patchFiles map[string]wharf.FileInfo, file string) wharf.FileInfo {
+	for _, p := range gzip.DecompressedPaths(file) {
+		if f, ok := patchFiles[p]; ok {
+			return f
+		}
+	}
+	return patchFiles[file]
+}
+
+// manifestLayers returns digests of layers of an image manifest, walking manifest lists and indexes
+// recursively and skipping child manifests not present in basePath
+func manifestLayers(manifestBytes []byte, basePath string) ([]digest.Digest, error) {
+	mimeType := manifest.GuessMIMEType(manifestBytes)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBytes, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		result := []digest.Digest{}
+		for _, instanceDigest := range list.Instances() {
+			instanceBytes, err := os.ReadFile(blobPath(basePath, instanceDigest))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			instanceLayers, err := manifestLayers(instanceBytes, basePath)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, instanceLayers...)
+		}
+		return result, nil
+	}
+
+	m, err := manifest.FromBlob(manifestBytes, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	result := []digest.Digest{}
+	for _, layerInfo := range m.LayerInfos() {
+		result = append(result, layerInfo.Digest)
+	}
+	return result, nil
+}
+
+// writeReport writes report to reportPath, in Markdown format if it has a .md extension and JSON otherwise
+func writeReport(report *Report, reportPath string) error {
+	f, err := os.Create(reportPath)
+	if err != nil {
+		return errors.Wrapf(err, "Error while creating report %v", reportPath)
+	}
+
+	switch strings.ToLower(filepath.Ext(reportPath)) {
+	case ".md", ".markdown":
+		err = writeMarkdownReport(report, f)
+	default:
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error while writing report %v", reportPath)
+	}
+	return nil
+}
+
+// writeMarkdownReport writes report in Markdown format to w
+func writeMarkdownReport(report *Report, w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Booster patch report: %v\n\n", report.Patch)
+	fmt.Fprintf(&b, "Booster version: %v\n\n", report.BoosterVersion)
+	fmt.Fprintf(&b, "| | Size (bytes) | Uncompressed (bytes) |\n|---|---:|---:|\n")
+	fmt.Fprintf(&b, "| Old images | %v | %v |\n", report.OldSize, report.UncompressedOldSize)
+	fmt.Fprintf(&b, "| New images | %v | %v |\n", report.NewSize, report.UncompressedNewSize)
+	fmt.Fprintf(&b, "| Push and pull update | %v | |\n", report.PushPullSize)
+	fmt.Fprintf(&b, "| Booster patch | %v | |\n\n", report.PatchSize)
+	fmt.Fprintf(&b, "Saving: %.0f %%\n", report.Saving)
+
+	fmt.Fprintf(&b, "\n## New images\n")
+	for _, image := range report.NewImages {
+		writeMarkdownImage(&b, image, true)
+	}
+	fmt.Fprintf(&b, "\n## Old images\n")
+	for _, image := range report.OldImages {
+		writeMarkdownImage(&b, image, false)
+	}
+
+	fmt.Fprintf(&b, "\n## Phases\n\n| Phase | Seconds |\n|---|---:|\n")
+	for _, phase := range report.Phases {
+		fmt.Fprintf(&b, "| %v | %.1f |\n", phase.Name, phase.Seconds)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMarkdownImage writes an ImageReport in Markdown format to b, with update and patch sizes if isNew
+func writeMarkdownImage(b *strings.Builder, image ImageReport, isNew bool) {
+	fmt.Fprintf(b, "\n### %v\n\n", image.Name)
+	fmt.Fprintf(b, "Digest: `%v`, size: %v bytes (%v uncompressed)", image.Digest, image.Size, image.UncompressedSize)
+	if !isNew {
+		fmt.Fprintf(b, "\n\n| Layer | Size | Uncompressed |\n|---|---:|---:|\n")
+		for _, layer := range image.Layers {
+			fmt.Fprintf(b, "| `%v` | %v | %v |\n", layer.Digest, layer.Size, layer.UncompressedSize)
+		}
+		return
+	}
+	fmt.Fprintf(b, ", push and pull update: %v bytes, patch: %v bytes\n\n", image.PushPullSize, image.PatchSize)
+	fmt.Fprintf(b, "| Layer | Status | Size | Uncompressed | Patch bytes |\n|---|---|---:|---:|---:|\n")
+	for _, layer := range image.Layers {
+		fmt.Fprintf(b, "| `%v` | %v | %v | %v | %v |\n", layer.Digest, layer.Status, layer.Size, layer.UncompressedSize, layer.PatchSize)
+	}
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// dropRegistryRule is the textual form of a RewriteRule dropping the registry host
+const dropRegistryRule = "drop-registry"
+
+// RewriteRule rewrites repository names of images in destinations
+type RewriteRule struct {
+	// DropRegistry drops the registry host, if any (eg. "docker.io/rancher/foo" -> "rancher/foo")
+	DropRegistry bool `yaml:"drop-registry"`
+	// Prefix, if found at the beginning of a repository name, is replaced with Replacement
+	Prefix string `yaml:"prefix"`
+	// Regex matches are replaced with Replacement, which can reference groups with $1, $2...
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+
+	compiled *regexp.Regexp
+}
+
+// Rewrites is an ordered list of RewriteRules
+type Rewrites []RewriteRule
+
+// rewritesFile is the format of rewrite rule files
+type rewritesFile struct {
+	Rewrites Rewrites `yaml:"rewrites"`
+}
+
+// ParseRewrite parses a rewrite rule in one of the following forms:
+//
+//	drop-registry
+//	prefix:PREFIX=REPLACEMENT
+//	regex:REGEX=REPLACEMENT
+func ParseRewrite(rule string) (RewriteRule, error) {
+	if rule == dropRegistryRule {
+		return RewriteRule{DropRegistry: true}, nil
+	}
+
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 {
+		return RewriteRule{}, errors.Errorf("Invalid rewrite rule %v, expected %v, prefix:PREFIX=REPLACEMENT or regex:REGEX=REPLACEMENT", rule, dropRegistryRule)
+	}
+	kind, body := parts[0], parts[1]
+	i := strings.LastIndex(body, "=")
+	if i < 0 {
+		return RewriteRule{}, errors.Errorf("Invalid rewrite rule %v, missing =REPLACEMENT", rule)
+	}
+	pattern, replacement := body[:i], body[i+1:]
+
+	var result RewriteRule
+	switch kind {
+	case "prefix":
+		result = RewriteRule{Prefix: pattern, Replacement: replacement}
+	case "regex":
+		result = RewriteRule{Regex: pattern, Replacement: replacement}
+	default:
+		return RewriteRule{}, errors.Errorf("Invalid rewrite rule %v, unknown kind %v", rule, kind)
+	}
+	if err := result.compile(); err != nil {
+		return RewriteRule{}, errors.Wrapf(err, "Invalid rewrite rule %v", rule)
+	}
+	return result, nil
+}
+
+// ReadRewrites reads rewrite rules from a YAML file in the following format:
+//
+//	rewrites:
+//	  - drop-registry: true
+//	  - prefix: rancher/
+//	    replacement: mirror/rancher/
+//	  - regex: ^library/(.*)$
+//	    replacement: mirror/$1
+func ReadRewrites(path string) (Rewrites, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while reading file %v", path)
+	}
+
+	var file rewritesFile
+	if err := yaml.UnmarshalStrict(bytes, &file); err != nil {
+		return nil, errors.Wrapf(err, "Error in rewrite rules file %v", path)
+	}
+	for i := range file.Rewrites {
+		if err := file.Rewrites[i].compile(); err != nil {
+			return nil, errors.Wrapf(err, "Error in rewrite rules file %v, rule %v", path, i+1)
+		}
+	}
+	return file.Rewrites, nil
+}
+
+// compile validates the rule and compiles its regex, if any
+func (r *RewriteRule) compile() error {
+	kinds := 0
+	if r.DropRegistry {
+		kinds++
+	}
+	if r.Prefix != "" {
+		kinds++
+	}
+	if r.Regex != "" {
+		kinds++
+		compiled, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return err
+		}
+		r.compiled = compiled
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of drop-registry, prefix or regex must be specified")
+	}
+	return nil
+}
+
+// Apply returns name with all rules applied in order
+// rules apply to the repository name, tags and digests are preserved
+func (r Rewrites) Apply(name string) string {
+	repository, suffix := splitRepository(name)
+	for _, rule := range r {
+		switch {
+		case rule.DropRegistry:
+			parts := strings.SplitN(repository, "/", 2)
+			if len(parts) == 2 && isRegistryHost(parts[0]) {
+				repository = parts[1]
+			}
+		case rule.Prefix != "":
+			if strings.HasPrefix(repository, rule.Prefix) {
+				repository = rule.Replacement + strings.TrimPrefix(repository, rule.Prefix)
+			}
+		case rule.compiled != nil:
+			repository = rule.compiled.ReplaceAllString(repository, rule.Replacement)
+		}
+	}
+	return repository + suffix
+}
+
+// splitRepository splits an image name into repository and tag and/or digest suffix
+// eg. "localhost:5000/ubuntu:18.04" -> "localhost:5000/ubuntu", ":18.04"
+func splitRepository(name string) (string, string) {
+	end := len(name)
+	if i := strings.Index(name, "@"); i >= 0 {
+		end = i
+	}
+	if i := strings.LastIndex(name[:end], ":"); i > strings.LastIndex(name[:end], "/") {
+		end = i
+	}
+	return name[:end], name[end:]
+}
+
+// isRegistryHost returns true if the first component of a repository name is a registry host,
+// following Docker's conventions
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
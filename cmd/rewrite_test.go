@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestParseRewrite(t *testing.T) {
+	cases := []struct {
+		rule     string
+		expected RewriteRule
+		// err is true if the rule is invalid
+		err bool
+	}{
+		{"drop-registry", RewriteRule{DropRegistry: true}, false},
+		{"prefix:rancher/=mirror/", RewriteRule{Prefix: "rancher/", Replacement: "mirror/"}, false},
+		{"prefix:rancher/=", RewriteRule{Prefix: "rancher/"}, false},
+		{"prefix:localhost:5000/=mirror/", RewriteRule{Prefix: "localhost:5000/", Replacement: "mirror/"}, false},
+		{"regex:^(.*)$=project/$1", RewriteRule{Regex: "^(.*)$", Replacement: "project/$1"}, false},
+		// the last = separates the replacement
+		{"regex:a=b=c", RewriteRule{Regex: "a=b", Replacement: "c"}, false},
+		{"drop-registry:true", RewriteRule{}, true},
+		{"rancher/=mirror/", RewriteRule{}, true},
+		{"prefix:rancher/", RewriteRule{}, true},
+		{"prefix:=mirror/", RewriteRule{}, true},
+		{"suffix:rancher/=mirror/", RewriteRule{}, true},
+		{"regex:(=mirror/", RewriteRule{}, true},
+		{"", RewriteRule{}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.rule, func(t *testing.T) {
+			rule, err := ParseRewrite(c.rule)
+			if c.err {
+				if err == nil {
+					t.Fatalf("invalid rule parsed as %+v", rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule.compiled = nil
+			if rule != c.expected {
+				t.Fatalf("parsed %+v, expected %+v", rule, c.expected)
+			}
+		})
+	}
+}
+
+func TestSplitRepository(t *testing.T) {
+	cases := []struct {
+		name       string
+		repository string
+		suffix     string
+	}{
+		{"ubuntu", "ubuntu", ""},
+		{"ubuntu:18.04", "ubuntu", ":18.04"},
+		{"localhost:5000/ubuntu", "localhost:5000/ubuntu", ""},
+		{"localhost:5000/ubuntu:18.04", "localhost:5000/ubuntu", ":18.04"},
+		{"ubuntu@sha256:" + sha256Hex, "ubuntu", "@sha256:" + sha256Hex},
+		{"localhost:5000/ubuntu:18.04@sha256:" + sha256Hex, "localhost:5000/ubuntu", ":18.04@sha256:" + sha256Hex},
+		{"localhost:5000/ubuntu@sha256:" + sha256Hex, "localhost:5000/ubuntu", "@sha256:" + sha256Hex},
+	}
+
+	for _, c := range cases {
+		repository, suffix := splitRepository(c.name)
+		if repository != c.repository || suffix != c.suffix {
+			t.Errorf("splitRepository(%q) = %q, %q, expected %q, %q", c.name, repository, suffix, c.repository, c.suffix)
+		}
+	}
+}
+
+func TestRewritesApply(t *testing.T) {
+	cases := []struct {
+		name     string
+		rules    []string
+		image    string
+		expected string
+	}{
+		{"no rules", nil, "rancher/rancher:v2.5.9", "rancher/rancher:v2.5.9"},
+		{"drop registry", []string{"drop-registry"}, "docker.io/rancher/rancher:v2.5.9", "rancher/rancher:v2.5.9"},
+		{"drop registry with port", []string{"drop-registry"}, "localhost:5000/rancher/rancher:v2.5.9", "rancher/rancher:v2.5.9"},
+		{"drop registry, none", []string{"drop-registry"}, "rancher/rancher:v2.5.9", "rancher/rancher:v2.5.9"},
+		{"drop registry, single component", []string{"drop-registry"}, "ubuntu:18.04", "ubuntu:18.04"},
+		{"prefix", []string{"prefix:rancher/=mirror/"}, "rancher/rancher:v2.5.9", "mirror/rancher:v2.5.9"},
+		{"prefix, digest", []string{"prefix:rancher/=mirror/"}, "rancher/rancher@sha256:" + sha256Hex, "mirror/rancher@sha256:" + sha256Hex},
+		{"prefix, tag and digest", []string{"prefix:rancher/=mirror/"}, "rancher/rancher:v2.5.9@sha256:" + sha256Hex, "mirror/rancher:v2.5.9@sha256:" + sha256Hex},
+		{"prefix, no match", []string{"prefix:rancher/=mirror/"}, "library/ubuntu:18.04", "library/ubuntu:18.04"},
+		// prefixes are plain strings, not path components
+		{"prefix not at a path boundary", []string{"prefix:rancher=mirror"}, "rancher-extra/agent:v1", "mirror-extra/agent:v1"},
+		{"prefix at a path boundary only", []string{"prefix:rancher/=mirror/"}, "rancher-extra/agent:v1", "rancher-extra/agent:v1"},
+		{"prefix does not match tags", []string{"prefix:ubuntu:=mirror/"}, "ubuntu:18.04", "ubuntu:18.04"},
+		{"prefix with registry port", []string{"prefix:localhost:5000/=mirror/"}, "localhost:5000/ubuntu:18.04", "mirror/ubuntu:18.04"},
+		{"strip prefix", []string{"prefix:rancher/="}, "rancher/rancher:v2.5.9", "rancher:v2.5.9"},
+		{"regex", []string{"regex:^(.*)$=project/$1"}, "ubuntu:18.04", "project/ubuntu:18.04"},
+		{"regex does not match tags", []string{"regex:18=20"}, "ubuntu18:18.04", "ubuntu20:18.04"},
+		{"rules in order", []string{"drop-registry", "prefix:rancher/=mirror/", "regex:^(.*)$=project/$1"}, "docker.io/rancher/rancher:v2.5.9", "project/mirror/rancher:v2.5.9"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rewrites := Rewrites{}
+			for _, r := range c.rules {
+				rule, err := ParseRewrite(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rewrites = append(rewrites, rule)
+			}
+			if actual := rewrites.Apply(c.image); actual != c.expected {
+				t.Fatalf("Apply(%q) = %q, expected %q", c.image, actual, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
+	"github.com/moio/booster/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// stateFileName is the name of the file recording progress of a diff in its temporary directory
+const stateFileName = "state.json"
+
+// Diff phases, in order
+const (
+	phaseStarted         = "started"
+	phaseOldDownloaded   = "old-downloaded"
+	phaseOldDecompressed = "old-decompressed"
+	phaseNewDownloaded   = "new-downloaded"
+	phaseNewDecompressed = "new-decompressed"
+	phasePatchCreated    = "patch-created"
+)
+
+// layerState records the result of decompressing a layer
+type layerState struct {
+	Recompressible   bool
+	UncompressedSize int64
+}
+
+// diffState records progress of a diff, so that it can be resumed
+type diffState struct {
+	path  string
+	mutex sync.Mutex
+
+	// Phase is the last phase reached
+	Phase string
+	// Images maps names of downloaded images to their manifest digests
+	Images map[string]digest.Digest
+	// GzipReconstruction is true if layers are decompressed along with reconstruction data
+	GzipReconstruction bool
+	// DeflateEncoder is the gzip.EncoderVersion layers are decompressed with
+	DeflateEncoder string
+	// Layers maps paths of blobs processed by gzip.Decompress to the result
+	Layers map[string]layerState
+	// Patch is the path of the last patch created
+	Patch string
+	// PatchHeader is the header of the last patch created
+	PatchHeader *patch.Header
+	// SplitSize is the volume size the last patch was split with, or 0 if it was not split
+	SplitSize int64
+}
+
+// loadDiffState loads the state file in tempDir if resume is true, otherwise starts a new one
+// layer results are discarded if they were recorded with a different gzipReconstruction setting or encoder version
+func loadDiffState(tempDir string, resume bool, gzipReconstruction bool) (*diffState, error) {
+	s := &diffState{
+		path:               filepath.Join(tempDir, stateFileName),
+		Phase:              phaseStarted,
+		Images:             map[string]digest.Digest{},
+		GzipReconstruction: gzipReconstruction,
+		DeflateEncoder:     gzip.EncoderVersion,
+		Layers:             map[string]layerState{},
+	}
+
+	if resume {
+		bytes, err := ioutil.ReadFile(s.path)
+		if os.IsNotExist(err) {
+			log.Warn().Str("path", s.path).Msg("No state to resume from, starting over")
+			return s, s.save()
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error while reading state file %v", s.path)
+		}
+		if err := json.Unmarshal(bytes, s); err != nil {
+			return nil, errors.Wrapf(err, "Error while parsing state file %v", s.path)
+		}
+		if s.GzipReconstruction != gzipReconstruction {
+			log.Warn().Bool("gzip_reconstruction", gzipReconstruction).Msg("Decompressing layers again, as gzip reconstruction setting changed")
+			s.GzipReconstruction = gzipReconstruction
+			s.Layers = map[string]layerState{}
+		}
+		if s.DeflateEncoder != gzip.EncoderVersion {
+			log.Warn().Str("encoder_version", gzip.EncoderVersion).Msg("Decompressing layers again, as encoder version changed")
+			// decompressed files were checked against the previous encoder, and would otherwise be reused
+			if err := gzip.Clean(filepath.Join(tempDir, "images")); err != nil && !os.IsNotExist(errors.Cause(err)) {
+				return nil, err
+			}
+			s.DeflateEncoder = gzip.EncoderVersion
+			s.Layers = map[string]layerState{}
+		}
+		log.Info().Str("phase", s.Phase).Int("images", len(s.Images)).Int("layers", len(s.Layers)).Msg("Resuming")
+	}
+
+	return s, s.save()
+}
+
+// save writes the state file atomically
+func (s *diffState) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveLocked()
+}
+
+// saveLocked writes the state file atomically, assuming the mutex is held
+func (s *diffState) saveLocked() error {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "Error while marshalling state")
+	}
+	tempPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, bytes, 0600); err != nil {
+		return errors.Wrapf(err, "Error while writing state file %v", tempPath)
+	}
+	if err := os.Rename(tempPath, s.path); err != nil {
+		return errors.Wrapf(err, "Error while writing state file %v", s.path)
+	}
+	return nil
+}
+
+// setPhase records that a phase was reached
+func (s *diffState) setPhase(phase string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Phase = phase
+	return s.saveLocked()
+}
+
+// imageDownloaded records that an image was downloaded
+func (s *diffState) imageDownloaded(image string, d digest.Digest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Images[image] = d
+	return s.saveLocked()
+}
+
+// cachedImage returns the manifest digest and files of an image downloaded in dir by a previous run
+// all files are validated by digest. Returns false if the image was not downloaded or is not valid
+func (s *diffState) cachedImage(image string, dir string) (digest.Digest, []string, bool) {
+	s.mutex.Lock()
+	d, ok := s.Images[image]
+	s.mutex.Unlock()
+	if !ok {
+		return "", nil, false
+	}
+
+	manifestBytes, err := ioutil.ReadFile(blobPath(dir, d))
+	if err != nil {
+		log.Warn().Str("image", image).Err(err).Msg("Cached image not found, downloading again")
+		return "", nil, false
+	}
+	files, err := manifestFiles(manifestBytes, dir)
+	if err != nil {
+		log.Warn().Str("image", image).Err(err).Msg("Cached image not valid, downloading again")
+		return "", nil, false
+	}
+	for _, file := range files {
+		if err := validateBlob(file); err != nil {
+			log.Warn().Str("image", image).Err(err).Msg("Cached image not valid, downloading again")
+			return "", nil, false
+		}
+	}
+
+	log.Info().Str("image", image).Msg("Already downloaded")
+	return d, files, true
+}
+
+// validateBlob returns an error if the file at path does not match the digest in its name
+// (as in the blobs directory of an OCI layout)
+func validateBlob(path string) error {
+	expected := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), filepath.Base(path))
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	actual, err := expected.Algorithm().FromReader(f)
+	if closeErr := f.Close(); closeErr != nil {
+		return closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return errors.Errorf("%v has digest %v", path, actual)
+	}
+	return nil
+}
+
+// decompress calls gzip.Decompress on files not processed by a previous run
+// and records results
+func (s *diffState) decompress(files *util.FileSet) (*util.FileSet, error) {
+	result := util.NewFileSet()
+	toDecompress := util.NewFileSet()
+	files.Walk(func(file string) {
+		layer, ok := s.Layers[file]
+		switch {
+		case ok && !layer.Recompressible:
+			result.AddWithParents(file)
+		case ok && decompressedPath(file, layer.UncompressedSize) != "":
+			for _, p := range gzip.WithSidecars(decompressedPath(file, layer.UncompressedSize)) {
+				result.AddWithParents(p)
+			}
+		default:
+			toDecompress.Add(file)
+		}
+	})
+	if toDecompress.Len() < files.Len() {
+		log.Info().Int("layers", files.Len()-toDecompress.Len()).Msg("Skipping already decompressed layers")
+	}
+	if toDecompress.Len() == 0 {
+		return result, nil
+	}
+
+	decompressed := gzip.Decompress(toDecompress, s.GzipReconstruction, nil)
+	toDecompress.Walk(func(file string) {
+		s.Layers[file] = layerState{Recompressible: false}
+		for _, p := range gzip.DecompressedPaths(file) {
+			if decompressed.Present(p) {
+				s.Layers[file] = layerState{Recompressible: true, UncompressedSize: fileSize(p)}
+			}
+		}
+	})
+	decompressed.Walk(func(file string) {
+		result.Add(file)
+	})
+
+	return result, s.save()
+}
+
+// patchCreated records that a patch was created with header
+func (s *diffState) patchCreated(patchPath string, header *patch.Header) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Phase = phasePatchCreated
+	s.Patch = patchPath
+	s.PatchHeader = header
+	s.SplitSize = 0
+	return s.saveLocked()
+}
+
+// patchSplit records that the last patch was split into volumes of splitSize bytes
+func (s *diffState) patchSplit(splitSize int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.SplitSize = splitSize
+	return s.saveLocked()
+}
+
+// patchExists returns true if a patch with header was already created in patchPath by a previous run
+// a patch already split into volumes of splitSize bytes is found via its index, if all volumes are there
+func (s *diffState) patchExists(patchPath string, header *patch.Header, splitSize int64) bool {
+	if s.Patch != patchPath || s.PatchHeader == nil {
+		return false
+	}
+	if _, err := os.Stat(patchPath); err != nil {
+		if splitSize <= 0 || s.SplitSize != splitSize {
+			return false
+		}
+		f, err := patch.Open(patchPath + patch.IndexSuffix)
+		if err != nil {
+			return false
+		}
+		if err := f.Close(); err != nil {
+			return false
+		}
+	}
+	expected, err := json.Marshal(header)
+	if err != nil {
+		return false
+	}
+	actual, err := json.Marshal(s.PatchHeader)
+	if err != nil {
+		return false
+	}
+	return string(expected) == string(actual)
+}
+
+// fileSize returns the size of a file, or -1 if it can't be determined
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// decompressedPath returns the path of the decompressed version of file, if one of size exists, or ""
+func decompressedPath(file string, size int64) string {
+	for _, p := range gzip.DecompressedPaths(file) {
+		if fileSize(p) == size {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moio/booster/gzip"
+	"github.com/moio/booster/patch"
+	"github.com/moio/booster/util"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// maxReportedMismatches limits the number of mismatching files listed in verification errors
+const maxReportedMismatches = 10
+
+// verify applies the patch at patchPath to a copy of oldFiles (decompressed files in imageDir) made in scratchDir,
+// recompresses layers and checks that every blob matches its digest and that all files of newImages are present
+// scratchDir is removed if verification succeeds, and kept for investigation otherwise
+func verify(patchPath string, imageDir string, oldFiles *util.FileSet, newImages []patch.Image, scratchDir string) error {
+	log.Info().Str("patch", patchPath).Msg("Verifying")
+
+	_, offset, err := readHeader(patchPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(scratchDir); err != nil {
+		return errors.Wrapf(err, "Error while cleaning verification directory %v", scratchDir)
+	}
+	scratchImageDir := filepath.Join(scratchDir, "images")
+	if err := copyFiles(oldFiles, imageDir, scratchImageDir); err != nil {
+		return errors.Wrap(err, "Error while copying old images for verification")
+	}
+
+	if err := applyPatch(patchPath, offset, scratchImageDir, filepath.Join(scratchDir, "patch")); err != nil {
+		return errors.Wrap(err, "Verification failed: error while applying patch")
+	}
+	if err := gzip.RecompressAllIn(scratchImageDir); err != nil {
+		return errors.Wrap(err, "Verification failed: error while recompressing files")
+	}
+
+	mismatches := []string{}
+	err = filepath.WalkDir(filepath.Join(scratchImageDir, "blobs"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || gzip.IsDecompressed(p) || gzip.IsSidecar(p) {
+			return nil
+		}
+		if err := validateBlob(p); err != nil {
+			log.Error().Str("path", p).Err(err).Msg("Blob does not match its digest")
+			mismatches = append(mismatches, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Verification failed: error while checking blobs")
+	}
+
+	for _, image := range newImages {
+		manifestBytes, err := os.ReadFile(blobPath(scratchImageDir, image.Digest))
+		if err != nil {
+			log.Error().Str("image", image.Name).Err(err).Msg("Manifest not found")
+			mismatches = append(mismatches, blobPath(scratchImageDir, image.Digest))
+			continue
+		}
+		files, err := manifestFiles(manifestBytes, scratchImageDir)
+		if err != nil {
+			return errors.Wrapf(err, "Verification failed: error while parsing manifest of image %v", image.Name)
+		}
+		for _, file := range files {
+			if _, err := os.Stat(file); err != nil {
+				log.Error().Str("image", image.Name).Err(err).Msg("File not found")
+				mismatches = append(mismatches, file)
+			}
+		}
+	}
+
+	if len(mismatches) > 0 {
+		reported := mismatches
+		if len(reported) > maxReportedMismatches {
+			reported = reported[:maxReportedMismatches]
+		}
+		return errors.Errorf("Verification failed: %v files missing or not matching their digests, including %v (see %v)",
+			len(mismatches), strings.Join(reported, ", "), scratchDir)
+	}
+
+	log.Info().Str("patch", patchPath).Msg("Verification succeeded")
+	return os.RemoveAll(scratchDir)
+}
+
+// copyFiles copies files (and directories) from sourceDir to destinationDir, preserving relative paths
+// files outside of sourceDir are skipped
+func copyFiles(files *util.FileSet, sourceDir string, destinationDir string) error {
+	relativeFiles, err := files.Relative(sourceDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range relativeFiles.Sorted() {
+		if file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+			continue
+		}
+		source := filepath.Join(sourceDir, file)
+		destination := filepath.Join(destinationDir, file)
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := os.MkdirAll(destination, 0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(source, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a regular file, creating parent directories as needed
+func copyFile(sourcePath string, destinationPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0700); err != nil {
+		return err
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.Create(destinationPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	return destination.Close()
+}
@@ -0,0 +1,79 @@
+package gzip
+
+import (
+	"bytes"
+	"sync"
+)
+
+// streamComparer compares a recompressed stream with the original compressed one while both are written to it,
+// in any order and possibly from different goroutines. Only bytes not yet written to both sides are kept,
+// and nothing after the first differing byte
+type streamComparer struct {
+	mutex        sync.Mutex
+	original     []byte
+	recompressed []byte
+	differs      bool
+}
+
+// originalWriter returns a writer for bytes of the original stream
+func (c *streamComparer) originalWriter() comparerSide {
+	return comparerSide{c, true}
+}
+
+// recompressedWriter returns a writer for bytes of the recompressed stream
+func (c *streamComparer) recompressedWriter() comparerSide {
+	return comparerSide{c, false}
+}
+
+// write adds p to one side and compares it with the other one
+func (c *streamComparer) write(p []byte, original bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.differs {
+		return
+	}
+	if original {
+		c.original = append(c.original, p...)
+	} else {
+		c.recompressed = append(c.recompressed, p...)
+	}
+
+	n := len(c.original)
+	if len(c.recompressed) < n {
+		n = len(c.recompressed)
+	}
+	if !bytes.Equal(c.original[:n], c.recompressed[:n]) {
+		c.differs = true
+		c.original = nil
+		c.recompressed = nil
+		return
+	}
+	c.original = c.original[n:]
+	c.recompressed = c.recompressed[n:]
+}
+
+// Differs returns true if a differing byte was written
+func (c *streamComparer) Differs() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.differs
+}
+
+// Equal returns true if both streams written so far are identical
+func (c *streamComparer) Equal() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.differs && len(c.original) == 0 && len(c.recompressed) == 0
+}
+
+// comparerSide writes to one side of a streamComparer
+type comparerSide struct {
+	comparer *streamComparer
+	original bool
+}
+
+// Write implements io.Writer
+func (s comparerSide) Write(p []byte) (int, error) {
+	s.comparer.write(p, s.original)
+	return len(p), nil
+}
@@ -0,0 +1,92 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	kgzip "github.com/klauspost/compress/gzip"
+)
+
+// comparerWrite is a write to one side of a streamComparer
+type comparerWrite struct {
+	original bool
+	p        string
+}
+
+func TestStreamComparer(t *testing.T) {
+	cases := []struct {
+		name   string
+		writes []comparerWrite
+		// differsAt is the index of the first write after which Differs is true, -1 if never
+		differsAt int
+		equal     bool
+	}{
+		{"equal streams", []comparerWrite{{true, "booster"}, {false, "boo"}, {false, "ster"}}, -1, true},
+		{"equal streams, recompressed first", []comparerWrite{{false, "booster"}, {true, "boo"}, {true, "ster"}}, -1, true},
+		{"empty streams", []comparerWrite{{true, ""}, {false, ""}}, -1, true},
+		{"difference in first chunk", []comparerWrite{{true, "booster"}, {false, "bXo"}, {false, "ster"}, {true, "more"}}, 1, false},
+		{"difference in later chunk", []comparerWrite{{true, "boo"}, {false, "boo"}, {true, "ster"}, {false, "stXr"}, {false, "more"}}, 3, false},
+		{"difference found once both sides are written", []comparerWrite{{false, "boo"}, {false, "ster"}, {true, "booXter"}}, 2, false},
+		{"original longer", []comparerWrite{{true, "booster"}, {false, "boo"}}, -1, false},
+		{"recompressed longer", []comparerWrite{{true, "boo"}, {false, "booster"}}, -1, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			comparer := &streamComparer{}
+			for i, w := range c.writes {
+				side := comparer.recompressedWriter()
+				if w.original {
+					side = comparer.originalWriter()
+				}
+				if _, err := side.Write([]byte(w.p)); err != nil {
+					t.Fatal(err)
+				}
+				expected := c.differsAt >= 0 && i >= c.differsAt
+				if comparer.Differs() != expected {
+					t.Fatalf("Differs is %v after write %v, expected %v", comparer.Differs(), i, expected)
+				}
+				if expected && (comparer.original != nil || comparer.recompressed != nil) {
+					t.Fatalf("bytes kept after write %v, once streams are known to differ", i)
+				}
+			}
+			if comparer.Equal() != c.equal {
+				t.Fatalf("Equal is %v, expected %v", comparer.Equal(), c.equal)
+			}
+		})
+	}
+}
+
+// countingReader counts bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestAbortingReader(t *testing.T) {
+	// not reproduced by compress/gzip at the same level, the only recipe tried
+	var original bytes.Buffer
+	w, err := kgzip.NewWriterLevel(&original, kgzip.BestSpeed)
+	writeGzip(t, w, err, testData(4*1024*1024))
+
+	source := &countingReader{r: bytes.NewReader(original.Bytes())}
+	r, err := newRecompressibilityReader(source, []Recipe{{encoderStdlib, gzip.BestSpeed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, abortingReader{r}); err != errNotRecompressible {
+		t.Fatalf("reading ended with %v, expected %v", err, errNotRecompressible)
+	}
+	if source.n >= original.Len()/2 {
+		t.Fatalf("%v of %v bytes read before stopping", source.n, original.Len())
+	}
+}
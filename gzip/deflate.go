@@ -0,0 +1,497 @@
+package gzip
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Deflate (RFC 1951) and gzip (RFC 1952) primitives used to parse streams from arbitrary encoders
+// and to write them back bit by bit, see reconstruction.go
+
+// Deflate block types
+const (
+	blockStored  = 0
+	blockFixed   = 1
+	blockDynamic = 2
+)
+
+const (
+	maxCodeBits      = 15
+	endOfBlockSymbol = 256
+	firstLengthCode  = 257
+	numLitLenCodes   = 286
+	numDistCodes     = 30
+)
+
+// gzip header flags
+const (
+	gzipFlagHeaderCRC = 1 << 1
+	gzipFlagExtra     = 1 << 2
+	gzipFlagName      = 1 << 3
+	gzipFlagComment   = 1 << 4
+	gzipFlagReserved  = 0xe0
+)
+
+// gzipTrailerSize is the size of the CRC-32 and size trailer of a gzip member
+const gzipTrailerSize = 8
+
+var (
+	lengthBase  = [...]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// codeLengthOrder is the order of code length code lengths in dynamic block headers
+	codeLengthOrder = [...]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLitLen, fixedDist = fixedHuffmans()
+)
+
+// errInvalidDeflate is returned when parsing streams which are corrupt, or valid but not reproducible
+// bit by bit from their symbols (eg. length 258 not encoded with code 285)
+var errInvalidDeflate = errors.New("invalid or unsupported deflate stream")
+
+// bitReader reads bits least significant first, as in deflate streams. Bits read are also written to rec, if not nil
+type bitReader struct {
+	r    io.ByteReader
+	bits uint64
+	n    uint
+	// offset is the number of bits read, plus any initial offset from a byte boundary
+	offset uint64
+	rec    *bitWriter
+}
+
+// readBits reads n bits (at most 32)
+func (b *bitReader) readBits(n uint) (uint32, error) {
+	for b.n < n {
+		c, err := b.r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		b.bits |= uint64(c) << b.n
+		b.n += 8
+	}
+	v := uint32(b.bits & (1<<n - 1))
+	b.bits >>= n
+	b.n -= n
+	b.offset += uint64(n)
+	if b.rec != nil {
+		if err := b.rec.writeBits(v, n); err != nil {
+			return 0, err
+		}
+	}
+	return v, nil
+}
+
+// align reads bits up to the next byte boundary
+func (b *bitReader) align() (uint32, error) {
+	return b.readBits(uint((8 - b.offset%8) % 8))
+}
+
+// bitWriter writes bits least significant first, as in deflate streams
+type bitWriter struct {
+	w    io.ByteWriter
+	bits uint64
+	n    uint
+	// count is the number of bits written
+	count uint64
+}
+
+// writeBits writes the n least significant bits of v (at most 32)
+func (b *bitWriter) writeBits(v uint32, n uint) error {
+	b.bits |= uint64(v) << b.n
+	b.n += n
+	b.count += uint64(n)
+	for b.n >= 8 {
+		if err := b.w.WriteByte(byte(b.bits)); err != nil {
+			return err
+		}
+		b.bits >>= 8
+		b.n -= 8
+	}
+	return nil
+}
+
+// writeBytes writes whole bytes, bits must be aligned to a byte boundary
+func (b *bitWriter) writeBytes(p []byte) error {
+	for _, c := range p {
+		if err := b.writeBits(uint32(c), 8); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes any pending bits, padded with zeros to a byte boundary
+func (b *bitWriter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	return b.writeBits(0, 8-b.n)
+}
+
+// huffman is a canonical Huffman code, as defined by code lengths of its symbols
+type huffman struct {
+	// counts is the number of codes of each length, symbols lists symbols ordered by code
+	counts  [maxCodeBits + 1]int
+	symbols []int
+	// codes and lengths are the bit-reversed code and the code length of each symbol
+	codes   []uint32
+	lengths []uint8
+}
+
+// newHuffman returns the canonical Huffman code with lengths. Incomplete codes are accepted
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{codes: make([]uint32, len(lengths)), lengths: lengths}
+	for _, l := range lengths {
+		h.counts[l]++
+	}
+	// unused symbols have no code
+	h.counts[0] = 0
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left = left<<1 - h.counts[l]
+		if left < 0 {
+			return nil, errInvalidDeflate
+		}
+	}
+
+	offsets := [maxCodeBits + 2]int{}
+	for l := 1; l <= maxCodeBits; l++ {
+		offsets[l+1] = offsets[l] + h.counts[l]
+	}
+	h.symbols = make([]int, offsets[maxCodeBits+1])
+	for symbol, l := range lengths {
+		if l != 0 {
+			h.symbols[offsets[l]] = symbol
+			offsets[l]++
+		}
+	}
+
+	next := [maxCodeBits + 1]uint32{}
+	for l := 2; l <= maxCodeBits; l++ {
+		next[l] = (next[l-1] + uint32(h.counts[l-1])) << 1
+	}
+	for symbol, l := range lengths {
+		if l != 0 {
+			h.codes[symbol] = reverseBits(next[l], uint(l))
+			next[l]++
+		}
+	}
+	return h, nil
+}
+
+// reverseBits reverses the n least significant bits of v
+func reverseBits(v uint32, n uint) uint32 {
+	result := uint32(0)
+	for i := uint(0); i < n; i++ {
+		result = result<<1 | v&1
+		v >>= 1
+	}
+	return result
+}
+
+// decode reads a symbol from br
+func (h *huffman) decode(br *bitReader) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		bit, err := br.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		count := h.counts[l]
+		if code-count < first {
+			return h.symbols[index+code-first], nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errInvalidDeflate
+}
+
+// write writes the code of symbol to bw
+func (h *huffman) write(bw *bitWriter, symbol int) error {
+	if symbol >= len(h.lengths) || h.lengths[symbol] == 0 {
+		return errInvalidDeflate
+	}
+	return bw.writeBits(h.codes[symbol], uint(h.lengths[symbol]))
+}
+
+// fixedHuffmans returns the literal/length and distance codes of fixed Huffman blocks
+func fixedHuffmans() (*huffman, *huffman) {
+	lengths := make([]uint8, 288)
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	litLen, _ := newHuffman(lengths)
+	distLengths := make([]uint8, 30)
+	for i := range distLengths {
+		distLengths[i] = 5
+	}
+	dist, _ := newHuffman(distLengths)
+	return litLen, dist
+}
+
+// blockHeader describes a deflate block
+type blockHeader struct {
+	final bool
+	btype uint32
+	// storedLength is the length of stored blocks
+	storedLength int
+	// litLen and dist are the codes of fixed and dynamic blocks
+	litLen *huffman
+	dist   *huffman
+}
+
+// readBlockHeader reads a block header from br
+func readBlockHeader(br *bitReader) (*blockHeader, error) {
+	final, err := br.readBits(1)
+	if err != nil {
+		return nil, err
+	}
+	btype, err := br.readBits(2)
+	if err != nil {
+		return nil, err
+	}
+	h := &blockHeader{final: final == 1, btype: btype}
+
+	switch btype {
+	case blockStored:
+		if _, err := br.align(); err != nil {
+			return nil, err
+		}
+		length, err := br.readBits(16)
+		if err != nil {
+			return nil, err
+		}
+		complement, err := br.readBits(16)
+		if err != nil {
+			return nil, err
+		}
+		if length != ^complement&0xffff {
+			return nil, errInvalidDeflate
+		}
+		h.storedLength = int(length)
+	case blockFixed:
+		h.litLen, h.dist = fixedLitLen, fixedDist
+	case blockDynamic:
+		h.litLen, h.dist, err = readDynamicCodes(br)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errInvalidDeflate
+	}
+	return h, nil
+}
+
+// readDynamicCodes reads the literal/length and distance codes of a dynamic block
+func readDynamicCodes(br *bitReader) (*huffman, *huffman, error) {
+	counts := [3]uint32{}
+	for i, bits := range []uint{5, 5, 4} {
+		v, err := br.readBits(bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		counts[i] = v
+	}
+	numLitLen, numDist, numCodeLength := int(counts[0])+257, int(counts[1])+1, int(counts[2])+4
+	if numLitLen > numLitLenCodes || numDist > numDistCodes {
+		return nil, nil, errInvalidDeflate
+	}
+
+	codeLengthLengths := make([]uint8, len(codeLengthOrder))
+	for i := 0; i < numCodeLength; i++ {
+		v, err := br.readBits(3)
+		if err != nil {
+			return nil, nil, err
+		}
+		codeLengthLengths[codeLengthOrder[i]] = uint8(v)
+	}
+	codeLengthCode, err := newHuffman(codeLengthLengths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lengths := make([]uint8, numLitLen+numDist)
+	for i := 0; i < len(lengths); {
+		symbol, err := codeLengthCode.decode(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		if symbol < 16 {
+			lengths[i] = uint8(symbol)
+			i++
+			continue
+		}
+
+		var value uint8
+		var repeat uint32
+		switch symbol {
+		case 16:
+			if i == 0 {
+				return nil, nil, errInvalidDeflate
+			}
+			value = lengths[i-1]
+			repeat, err = br.readBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = br.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = br.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if i+int(repeat) > len(lengths) {
+			return nil, nil, errInvalidDeflate
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	if lengths[endOfBlockSymbol] == 0 {
+		return nil, nil, errInvalidDeflate
+	}
+
+	litLen, err := newHuffman(lengths[:numLitLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	dist, err := newHuffman(lengths[numLitLen:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return litLen, dist, nil
+}
+
+// readLength reads the extra bits of a length symbol and returns the length
+func readLength(br *bitReader, symbol int) (int, error) {
+	i := symbol - firstLengthCode
+	if i < 0 || i >= len(lengthBase) {
+		return 0, errInvalidDeflate
+	}
+	extra, err := br.readBits(lengthExtra[i])
+	if err != nil {
+		return 0, err
+	}
+	length := lengthBase[i] + int(extra)
+	// only lengths encoded as writeLength would can be reproduced
+	if lengthCode(length) != i {
+		return 0, errInvalidDeflate
+	}
+	return length, nil
+}
+
+// readDistance reads a distance symbol and its extra bits and returns the distance
+func readDistance(br *bitReader, dist *huffman) (int, error) {
+	i, err := dist.decode(br)
+	if err != nil {
+		return 0, err
+	}
+	if i >= len(distBase) {
+		return 0, errInvalidDeflate
+	}
+	extra, err := br.readBits(distExtra[i])
+	if err != nil {
+		return 0, err
+	}
+	return distBase[i] + int(extra), nil
+}
+
+// lengthCode returns the index of the length code for length
+func lengthCode(length int) int {
+	i := len(lengthBase) - 1
+	for lengthBase[i] > length {
+		i--
+	}
+	return i
+}
+
+// distCode returns the index of the distance code for distance
+func distCode(distance int) int {
+	i := len(distBase) - 1
+	for distBase[i] > distance {
+		i--
+	}
+	return i
+}
+
+// writeMatch writes length and distance symbols and extra bits
+func writeMatch(bw *bitWriter, h *blockHeader, length int, distance int) error {
+	if length < minMatchLength || length > maxMatchLength || distance < 1 || distance > windowSize {
+		return errInvalidDeflate
+	}
+	l := lengthCode(length)
+	if err := h.litLen.write(bw, firstLengthCode+l); err != nil {
+		return err
+	}
+	if err := bw.writeBits(uint32(length-lengthBase[l]), lengthExtra[l]); err != nil {
+		return err
+	}
+	d := distCode(distance)
+	if err := h.dist.write(bw, d); err != nil {
+		return err
+	}
+	return bw.writeBits(uint32(distance-distBase[d]), distExtra[d])
+}
+
+// readGzipHeader reads a gzip member header from r, returning it verbatim
+func readGzipHeader(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, gzipHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&gzipFlagReserved != 0 {
+		return nil, errInvalidDeflate
+	}
+	flags := header[3]
+
+	if flags&gzipFlagExtra != 0 {
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return nil, err
+		}
+		extra := make([]byte, int(size[0])|int(size[1])<<8)
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return nil, err
+		}
+		header = append(append(header, size...), extra...)
+	}
+	for _, flag := range []byte{gzipFlagName, gzipFlagComment} {
+		if flags&flag != 0 {
+			s, err := r.ReadBytes(0)
+			if err != nil {
+				return nil, err
+			}
+			header = append(header, s...)
+		}
+	}
+	if flags&gzipFlagHeaderCRC != 0 {
+		crc := make([]byte, 2)
+		if _, err := io.ReadFull(r, crc); err != nil {
+			return nil, err
+		}
+		header = append(header, crc...)
+	}
+	return header, nil
+}
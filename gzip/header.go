@@ -0,0 +1,53 @@
+package gzip
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderSuffix is appended to paths of decompressed files to obtain paths of their gzip headers, if not default
+const HeaderSuffix = "_HEADER"
+
+// gzipUnknownOS is the OS field written by gzip.Writer by default
+const gzipUnknownOS = 255
+
+// HeaderPath returns the path of the gzip header of the decompressed file at path
+func HeaderPath(path string) string {
+	return path + HeaderSuffix
+}
+
+// isDefaultHeader returns true if h is the header written by a new gzip.Writer
+func isDefaultHeader(h *gzip.Header) bool {
+	return h.Name == "" && h.Comment == "" && len(h.Extra) == 0 && h.ModTime.IsZero() && h.OS == gzipUnknownOS
+}
+
+// readHeader reads the gzip header of the decompressed file at path, returns nil if it is the default one
+func readHeader(path string) (*gzip.Header, error) {
+	bytes, err := os.ReadFile(HeaderPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var header gzip.Header
+	if err := json.Unmarshal(bytes, &header); err != nil {
+		return nil, errors.Wrapf(err, "invalid gzip header %v", HeaderPath(path))
+	}
+	return &header, nil
+}
+
+// writeHeader writes the gzip header of the decompressed file at path, unless it is the default one
+func writeHeader(path string, header *gzip.Header) error {
+	if header == nil || isDefaultHeader(header) {
+		return nil
+	}
+	bytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(HeaderPath(path), bytes, 0644)
+}
@@ -0,0 +1,87 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moio/booster/gzip/pinned/go125"
+)
+
+func TestHeader(t *testing.T) {
+	data := testData(64 * 1024)
+	modTime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		header gzip.Header
+		// sidecar is true if the header differs from the default one, and has to be stored
+		sidecar bool
+	}{
+		{"default", gzip.Header{OS: gzipUnknownOS}, false},
+		{"name", gzip.Header{Name: "layer.tar", OS: gzipUnknownOS}, true},
+		{"modification time", gzip.Header{ModTime: modTime, OS: gzipUnknownOS}, true},
+		{"OS", gzip.Header{OS: 3}, true},
+		{"extra", gzip.Header{Extra: []byte{'B', 'O', 4, 0, 1, 2, 3, 4}, OS: gzipUnknownOS}, true},
+		{"comment", gzip.Header{Comment: "booster", OS: gzipUnknownOS}, true},
+		{"all fields", gzip.Header{Name: "layer.tar", Comment: "booster", Extra: []byte{'B', 'O', 0, 0}, ModTime: modTime, OS: 3}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var original bytes.Buffer
+			w, err := go125.NewWriterLevel(&original, gzip.DefaultCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Header = c.header
+			writeGzip(t, w, nil, data)
+
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "layer.gz")
+			decompressedPath := sourcePath + Suffix
+			if err := os.WriteFile(sourcePath, original.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			ok, err := decompress(sourcePath, decompressedPath, formats[0], false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("not decompressed")
+			}
+			if _, err := os.Stat(HeaderPath(decompressedPath)); (err == nil) != c.sidecar {
+				t.Fatalf("header sidecar found: %v, expected: %v", err == nil, c.sidecar)
+			}
+
+			header, err := readHeader(decompressedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.sidecar {
+				if header.Name != c.header.Name || header.Comment != c.header.Comment || !bytes.Equal(header.Extra, c.header.Extra) ||
+					!header.ModTime.Equal(c.header.ModTime) || header.OS != c.header.OS {
+					t.Fatalf("read header %+v, expected %+v", *header, c.header)
+				}
+			}
+
+			if err := os.Remove(sourcePath); err != nil {
+				t.Fatal(err)
+			}
+			if err := compress(decompressedPath, sourcePath); err != nil {
+				t.Fatal(err)
+			}
+			recompressed, err := os.ReadFile(sourcePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(recompressed, original.Bytes()) {
+				t.Fatalf("recompressed %v bytes differ from the original %v bytes", len(recompressed), original.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package go125
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+)
+
+// Definitions from compress/gzip's gunzip.go, which is not copied as decompression output does not change
+
+const (
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+var le = binary.LittleEndian
+
+// Header is compress/gzip's Header, so that headers read by compress/gzip can be written back
+type Header = gzip.Header
@@ -0,0 +1,9 @@
+// Package go125 contains copies of the compress/gzip encoder and of the compress/flate encoder it uses (package flate)
+// from the Go 1.25.14 standard library, so that their output does not change when booster is built with a different
+// Go version. This is the deflate encoder Go used up to 1.25, which wrote most existing gzip layers.
+// Files copied from Go are only changed in package names and imports, see LICENSE for their license.
+package go125
+
+// Version identifies the encoders in this package. It must change whenever they are updated, as their output
+// may change as well
+const Version = "go1.25.14"
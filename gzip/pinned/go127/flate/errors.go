@@ -0,0 +1,8 @@
+package flate
+
+// Definitions from compress/flate's inflate.go, which is not copied as decompression output does not change
+
+// An InternalError reports an error in the flate code itself.
+type InternalError string
+
+func (e InternalError) Error() string { return "flate: internal error: " + string(e) }
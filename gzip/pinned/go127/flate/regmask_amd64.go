@@ -0,0 +1,9 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flate
+
+// shiftMask is a no-op shift mask for x86-64.
+// Using it lets the compiler omit the check for shift size >= 64.
+const reg8SizeMask64 = 63
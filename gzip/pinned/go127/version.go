@@ -0,0 +1,9 @@
+// Package go127 contains copies of the compress/gzip encoder and of the compress/flate encoder it uses (package flate)
+// from the Go 1.27.1 standard library, so that their output does not change when booster is built with a different
+// Go version. compress/flate was rewritten in Go 1.26, this is the deflate encoder of Go 1.26 and later.
+// Files copied from Go are only changed in package names and imports, see LICENSE for their license.
+package go127
+
+// Version identifies the encoders in this package. It must change whenever they are updated, as their output
+// may change as well
+const Version = "go1.27.1"
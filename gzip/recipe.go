@@ -0,0 +1,159 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	kgzip "github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
+	"github.com/moio/booster/gzip/pinned/go125"
+	"github.com/moio/booster/gzip/pinned/go127"
+	"github.com/pkg/errors"
+)
+
+// RecipeSuffix is appended to paths of decompressed files to obtain paths of their recipes, if any
+const RecipeSuffix = "_RECIPE"
+
+// Encoders of gzip files that can be reproduced. compress/gzip is reproduced by package go125 up to Go 1.25,
+// and by package go127 from Go 1.26, which rewrote compress/flate
+const (
+	encoderStdlib    = "compress/gzip"
+	encoderStdlib126 = "compress/gzip@go1.26"
+	encoderKlauspost = "klauspost/compress/gzip"
+	encoderPgzip     = "klauspost/pgzip"
+	encoderZstd      = "klauspost/compress/zstd"
+)
+
+// gzipHeaderSize is the size of gzip headers without optional fields
+const gzipHeaderSize = 10
+
+// Recipe describes how to recompress a decompressed file. Recipes are stored next to decompressed files,
+// in JSON format, along with the EncoderVersion they were found with
+type Recipe struct {
+	Encoder string
+	Level   int
+}
+
+// recipeFile is the format of stored recipes
+type recipeFile struct {
+	Recipe
+	// EncoderVersion is the EncoderVersion of the booster which decompressed the file
+	EncoderVersion string
+}
+
+// gzipRecipes lists recipes tried, in order, on gzip files not reproduced by compress/gzip at the default level:
+// containers/image's pgzip and Go 1.26's compress/gzip at the default level first, then other encoders and levels
+var gzipRecipes = []Recipe{
+	{encoderPgzip, pgzip.DefaultCompression},
+	{encoderStdlib126, gzip.DefaultCompression},
+	{encoderKlauspost, kgzip.DefaultCompression},
+	{encoderStdlib, gzip.BestCompression},
+	{encoderStdlib, gzip.BestSpeed},
+	{encoderPgzip, pgzip.BestCompression},
+	{encoderPgzip, pgzip.BestSpeed},
+	{encoderKlauspost, kgzip.BestCompression},
+	{encoderKlauspost, kgzip.BestSpeed},
+	{encoderStdlib, 2}, {encoderStdlib, 3}, {encoderStdlib, 4}, {encoderStdlib, 5}, {encoderStdlib, 7}, {encoderStdlib, 8},
+	{encoderStdlib, gzip.HuffmanOnly},
+	{encoderPgzip, 2}, {encoderPgzip, 3}, {encoderPgzip, 4}, {encoderPgzip, 5}, {encoderPgzip, 6}, {encoderPgzip, 7}, {encoderPgzip, 8},
+	{encoderKlauspost, 2}, {encoderKlauspost, 3}, {encoderKlauspost, 4}, {encoderKlauspost, 5}, {encoderKlauspost, 6}, {encoderKlauspost, 7}, {encoderKlauspost, 8},
+	{encoderKlauspost, kgzip.HuffmanOnly},
+	{encoderStdlib126, gzip.BestCompression},
+	{encoderStdlib126, gzip.BestSpeed},
+	{encoderStdlib126, 2}, {encoderStdlib126, 3}, {encoderStdlib126, 4}, {encoderStdlib126, 5}, {encoderStdlib126, 7}, {encoderStdlib126, 8},
+	{encoderStdlib126, gzip.HuffmanOnly},
+}
+
+// defaultRecipe describes the gzip.Writer used by default
+var defaultRecipe = Recipe{encoderStdlib, gzip.DefaultCompression}
+
+// zstdRecipe describes the zstd encoder, see newZstdWriter
+var zstdRecipe = Recipe{encoderZstd, 0}
+
+// newWriter returns a writer compressing to w as described by the recipe, writing header if not nil (gzip only)
+func (r Recipe) newWriter(w io.Writer, header *gzip.Header) (io.WriteCloser, error) {
+	switch r.Encoder {
+	case encoderZstd:
+		return newZstdWriter(w)
+	case encoderStdlib:
+		writer, err := go125.NewWriterLevel(w, r.Level)
+		if err == nil && header != nil {
+			writer.Header = *header
+		}
+		return writer, err
+	case encoderStdlib126:
+		writer, err := go127.NewWriterLevel(w, r.Level)
+		if err == nil && header != nil {
+			writer.Header = *header
+		}
+		return writer, err
+	case encoderKlauspost:
+		writer, err := kgzip.NewWriterLevel(w, r.Level)
+		if err == nil && header != nil {
+			writer.Header = kgzip.Header{Comment: header.Comment, Extra: header.Extra, ModTime: header.ModTime, Name: header.Name, OS: header.OS}
+		}
+		return writer, err
+	case encoderPgzip:
+		writer, err := pgzip.NewWriterLevel(w, r.Level)
+		if err == nil && header != nil {
+			writer.Header = pgzip.Header{Comment: header.Comment, Extra: header.Extra, ModTime: header.ModTime, Name: header.Name, OS: header.OS}
+		}
+		return writer, err
+	}
+	return nil, errors.Errorf("unknown encoder %v", r.Encoder)
+}
+
+// header returns the gzip header written by the recipe's encoder with header fields from header, if not nil:
+// extra flags depend on the level, and encoders treat zero modification times differently, so headers are used
+// to rule out recipes quickly
+func (r Recipe) header(header *gzip.Header) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := r.newWriter(&b, header)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes()[:gzipHeaderSize], nil
+}
+
+// IsSidecar returns true if path is the path of a recipe, a gzip header or reconstruction data
+func IsSidecar(path string) bool {
+	return strings.HasSuffix(path, RecipeSuffix) || strings.HasSuffix(path, HeaderSuffix) || strings.HasSuffix(path, ReconstructionSuffix)
+}
+
+// RecipePath returns the path of the recipe of the decompressed file at path
+func RecipePath(path string) string {
+	return path + RecipeSuffix
+}
+
+// readRecipe reads the recipe of the decompressed file at path and the EncoderVersion it was found with
+// returns nil if there is none
+func readRecipe(path string) (*Recipe, string, error) {
+	bytes, err := os.ReadFile(RecipePath(path))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var file recipeFile
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return nil, "", errors.Wrapf(err, "invalid recipe %v", RecipePath(path))
+	}
+	return &file.Recipe, file.EncoderVersion, nil
+}
+
+// writeRecipe writes the recipe of the decompressed file at path, recording this booster's EncoderVersion
+func writeRecipe(path string, recipe *Recipe) error {
+	bytes, err := json.Marshal(recipeFile{Recipe: *recipe, EncoderVersion: EncoderVersion})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(RecipePath(path), bytes, 0644)
+}
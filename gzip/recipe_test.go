@@ -0,0 +1,149 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	kgzip "github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
+	"github.com/moio/booster/gzip/pinned/go125"
+	"github.com/moio/booster/gzip/pinned/go127"
+)
+
+// writeGzip compresses data with w, as returned by an encoder's NewWriterLevel
+func writeGzip(t *testing.T, w io.WriteCloser, err error, data []byte) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecipes(t *testing.T) {
+	data := testData(256 * 1024)
+	modTime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		gzip func(t *testing.T) []byte
+		// recipe is the expected recipe, nil if none should reproduce the file
+		recipe *Recipe
+	}{
+		{"compress/gzip up to Go 1.25", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := go125.NewWriterLevel(&b, gzip.DefaultCompression)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &defaultRecipe},
+		{"compress/gzip up to Go 1.25, best compression", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := go125.NewWriterLevel(&b, gzip.BestCompression)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderStdlib, gzip.BestCompression}},
+		{"compress/gzip from Go 1.26", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := go127.NewWriterLevel(&b, gzip.DefaultCompression)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderStdlib126, gzip.DefaultCompression}},
+		{"compress/gzip from Go 1.26, level 5", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := go127.NewWriterLevel(&b, 5)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderStdlib126, 5}},
+		{"pgzip", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := pgzip.NewWriterLevel(&b, pgzip.DefaultCompression)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderPgzip, pgzip.DefaultCompression}},
+		{"pgzip, best speed", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := pgzip.NewWriterLevel(&b, pgzip.BestSpeed)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderPgzip, pgzip.BestSpeed}},
+		{"klauspost", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := kgzip.NewWriterLevel(&b, kgzip.DefaultCompression)
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderKlauspost, kgzip.DefaultCompression}},
+		{"klauspost, best compression, with name and modification time", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			w, err := kgzip.NewWriterLevel(&b, kgzip.BestCompression)
+			if err == nil {
+				w.Name = "layer.tar"
+				w.ModTime = modTime
+			}
+			writeGzip(t, w, err, data)
+			return b.Bytes()
+		}, &Recipe{encoderKlauspost, kgzip.BestCompression}},
+		{"GNU gzip", func(t *testing.T) []byte { return gnuGzip(t, data, "-6") }, nil},
+		{"multiple members", func(t *testing.T) []byte {
+			var b bytes.Buffer
+			for _, part := range [][]byte{data[:1000], data[1000:]} {
+				w, err := go125.NewWriterLevel(&b, gzip.DefaultCompression)
+				writeGzip(t, w, err, part)
+			}
+			return b.Bytes()
+		}, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			original := c.gzip(t)
+
+			r, err := newRecompressibilityReader(bytes.NewReader(original), append([]Recipe{defaultRecipe}, gzipRecipes...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Fatal("decompressed data differs from the original")
+			}
+
+			recipe := r.Recipe()
+			if c.recipe == nil {
+				if recipe != nil {
+					t.Fatalf("found recipe %v, expected none", *recipe)
+				}
+				if !r.Differs() {
+					t.Fatal("stream not reported as differing from every recipe")
+				}
+				return
+			}
+			if recipe == nil {
+				t.Fatalf("no recipe found, expected %v", *c.recipe)
+			}
+			if *recipe != *c.recipe {
+				t.Fatalf("found recipe %v, expected %v", *recipe, *c.recipe)
+			}
+			if r.TransparentlyRecompressible() != (*recipe == defaultRecipe) {
+				t.Fatal("TransparentlyRecompressible does not match the default recipe")
+			}
+
+			var recompressed bytes.Buffer
+			w, err := recipe.newWriter(&recompressed, r.Header())
+			writeGzip(t, w, err, decompressed)
+			if !bytes.Equal(recompressed.Bytes(), original) {
+				t.Fatalf("recompressed %v bytes differ from the original %v bytes", recompressed.Len(), len(original))
+			}
+		})
+	}
+}
@@ -3,59 +3,180 @@ package gzip
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/sha512"
-	"hash"
 	"io"
+
+	"github.com/moio/booster/gzip/pinned/go125"
+	"github.com/moio/booster/gzip/pinned/go127"
+)
+
+// Versions of klauspost modules, whose encoders recompress zstd files and gzip files with some recipes
+// they must match go.mod, see TestEncoderVersion
+const (
+	klauspostCompressVersion = "v1.13.4"
+	klauspostPgzipVersion    = "v1.2.5"
 )
 
+// EncoderVersion identifies the encoders files are recompressed with: go125's for gzip files by default, go127's and
+// klauspost's for other gzip recipes and klauspost's for zstd files. Files decompressed by booster with an
+// EncoderVersion can only be recompressed transparently with the same EncoderVersion
+const EncoderVersion = go125.Version + "+" + go127.Version + "+klauspost/compress@" + klauspostCompressVersion + "+klauspost/pgzip@" + klauspostPgzipVersion
+
 // RecompressibilityReader is a gzip reader which checks, while reading, whether the file can be
 // later be recompressed resulting in the exact same binary ("transparent recompressibility").
 // This is currently the case if the gzip stream was created with Go's implementation
-// and standard compression level
+// and standard compression level, up to Go 1.25 (as of the Go version of package go125, see EncoderVersion). Header fields
+// (name, comment, extra, modification time and OS) are preserved, see Header.
+// Recompressed bytes are compared with the original ones as soon as they are available, see Differs
 type RecompressibilityReader struct {
-	reader *gzip.Reader
-	writer *gzip.Writer
-	tee2   io.Reader
-	h1     hash.Hash
-	h2     hash.Hash
+	reader     *gzip.Reader
+	candidates []*recompressionCandidate
+}
+
+// recompressionCandidate recompresses decompressed bytes as described by a recipe, comparing them with the original
+type recompressionCandidate struct {
+	recipe   Recipe
+	writer   io.WriteCloser
+	comparer *streamComparer
+	closed   bool
+}
+
+// candidateFanout writes bytes of the original stream to the comparers of all candidates
+// bytes written before candidates are known are kept in prefix
+type candidateFanout struct {
+	prefix     []byte
+	candidates []*recompressionCandidate
+}
+
+// Write implements io.Writer
+func (f *candidateFanout) Write(p []byte) (int, error) {
+	if f.candidates == nil {
+		f.prefix = append(f.prefix, p...)
+		return len(p), nil
+	}
+	for _, c := range f.candidates {
+		if !c.closed {
+			c.comparer.write(p, true)
+		}
+	}
+	return len(p), nil
 }
 
 // NewRecompressibilityReader returns a gzip.RecompressibilityReader which also checks whether its contents can be recompressed transparently
 func NewRecompressibilityReader(r io.Reader) (*RecompressibilityReader, error) {
-	// r -> tee1 -> h1
-	//       |----> reader -> tee2 -> writer -> h2
+	return newRecompressibilityReader(r, []Recipe{defaultRecipe})
+}
+
+// newRecompressibilityReader returns a RecompressibilityReader which also checks whether its contents can be
+// recompressed with any of recipes, in order. Recipes whose gzip header differs from the original are skipped
+func newRecompressibilityReader(r io.Reader, recipes []Recipe) (*RecompressibilityReader, error) {
+	// r -> tee -> fanout -> comparers
+	//       |----> reader -> Read -> candidate writers -> comparers
 	//                         |----> caller
 
-	h1 := sha512.New()
-	tee1 := io.TeeReader(r, h1)
-	reader, err := gzip.NewReader(tee1)
+	fanout := &candidateFanout{}
+	reader, err := gzip.NewReader(io.TeeReader(r, fanout))
 	if err != nil {
 		return nil, err
 	}
 
-	h2 := sha512.New()
-	writer := gzip.NewWriter(h2)
-	tee2 := io.TeeReader(reader, writer)
+	// the header was read, and is in the prefix
+	candidates := []*recompressionCandidate{}
+	for _, recipe := range recipes {
+		recipeHeader, err := recipe.header(&reader.Header)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(fanout.prefix, recipeHeader) {
+			continue
+		}
 
-	return &RecompressibilityReader{tee2: tee2, h1: h1, reader: reader, writer: writer, h2: h2}, nil
+		comparer := &streamComparer{}
+		writer, err := recipe.newWriter(comparer.recompressedWriter(), &reader.Header)
+		if err != nil {
+			return nil, err
+		}
+		comparer.write(fanout.prefix, true)
+		candidates = append(candidates, &recompressionCandidate{recipe: recipe, writer: writer, comparer: comparer})
+	}
+	fanout.candidates = candidates
+	fanout.prefix = nil
+
+	return &RecompressibilityReader{reader: reader, candidates: candidates}, nil
 }
 
 // Read implements io.Reader
-func (r RecompressibilityReader) Read(p []byte) (n int, err error) {
-	return r.tee2.Read(p)
+func (r *RecompressibilityReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	for _, c := range r.candidates {
+		if c.closed {
+			continue
+		}
+		if _, err := c.writer.Write(p[:n]); err != nil {
+			return n, err
+		}
+		if c.comparer.Differs() {
+			// stop recompressing with this candidate
+			if err := c.close(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
 }
 
-// Read implements io.Closer
-func (r RecompressibilityReader) Close() error {
+// close closes the writer of candidate c, flushing any remaining bytes to its comparer
+func (c *recompressionCandidate) close() error {
+	c.closed = true
+	return c.writer.Close()
+}
+
+// Close implements io.Closer
+func (r *RecompressibilityReader) Close() error {
 	err := r.reader.Close()
 	if err != nil {
 		return err
 	}
-	return r.writer.Close()
+	for _, c := range r.candidates {
+		if c.closed {
+			continue
+		}
+		if err := c.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Header returns the header of the gzip stream, which has to be restored when recompressing
+func (r *RecompressibilityReader) Header() *gzip.Header {
+	return &r.reader.Header
+}
+
+// Differs returns true as soon as bytes read so far, once recompressed, are known to differ from the original
+// archive with every recipe, even before reading is complete
+func (r *RecompressibilityReader) Differs() bool {
+	for _, c := range r.candidates {
+		if !c.comparer.Differs() {
+			return false
+		}
+	}
+	return true
+}
+
+// Recipe returns the first recipe which, after Close, reconstructs the original archive exactly, or nil if none does
+func (r *RecompressibilityReader) Recipe() *Recipe {
+	for _, c := range r.candidates {
+		if c.comparer.Equal() {
+			recipe := c.recipe
+			return &recipe
+		}
+	}
+	return nil
 }
 
-// TransparentlyRecompressible returns true if bytes read so far, once recompressed with compress/gzip's Writer,
-// reconstruct the original archive exactly
-func (r RecompressibilityReader) TransparentlyRecompressible() bool {
-	return bytes.Equal(r.h1.Sum(nil), r.h2.Sum(nil))
+// TransparentlyRecompressible returns true if bytes read so far, once recompressed with go125's Writer
+// and the original header, reconstruct the original archive exactly
+func (r *RecompressibilityReader) TransparentlyRecompressible() bool {
+	recipe := r.Recipe()
+	return recipe != nil && *recipe == defaultRecipe
 }
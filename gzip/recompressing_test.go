@@ -0,0 +1,33 @@
+package gzip
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestEncoderVersion(t *testing.T) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		t.Skip("no build information")
+	}
+	expected := map[string]string{
+		"github.com/klauspost/compress": klauspostCompressVersion,
+		"github.com/klauspost/pgzip":    klauspostPgzipVersion,
+	}
+	for _, dep := range info.Deps {
+		version, ok := expected[dep.Path]
+		if !ok {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		if dep.Version != version {
+			t.Errorf("%v is at %v, but EncoderVersion has %v: update it", dep.Path, dep.Version, version)
+		}
+		delete(expected, dep.Path)
+	}
+	for path := range expected {
+		t.Errorf("%v not found in build information", path)
+	}
+}
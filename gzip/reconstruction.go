@@ -0,0 +1,761 @@
+package gzip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ReconstructionSuffix is appended to paths of decompressed files to obtain paths of their reconstruction data, if any
+const ReconstructionSuffix = "_RECONSTRUCTION"
+
+// reconstructionMagic starts every reconstruction data file
+const reconstructionMagic = "BOOSTER_RECONSTRUCTION_1\n"
+
+// Reconstruction data describes a gzip file as a sequence of records, so that it can be rebuilt bit by bit from
+// its decompressed version whatever the encoder (GNU gzip, pigz, zlib-ng...). Records hold gzip headers and
+// trailers, deflate block headers and the sequence of literals and matches (LZ77 parse) chosen by the encoder.
+// Literal bytes are not stored, as they are read from decompressed data; matches are stored as differences from
+// the matches a simple predictor would choose, so that most are a couple of zero bytes. Records are not compressed
+// and change little when data does, so that they are compressed and diffed efficiently in patches
+const (
+	// recordMember: uvarint length and verbatim gzip member header
+	recordMember = 'M'
+	// recordBlock: uvarint number of bits and bits of a deflate block header (including stored block length)
+	recordBlock = 'B'
+	// recordLiterals: uvarint number of literals
+	recordLiterals = 'L'
+	// recordMatch: uvarint rank of the match among predicted ones (0 if not predicted, followed by
+	// uvarint distance), uvarint difference from predicted length (length if not predicted)
+	recordMatch = 'C'
+	// recordPredictedMatch: match with rank 1 and no difference from predicted length, the vast majority
+	recordPredictedMatch = 'P'
+	// recordEndOfBlock: end of a compressed block
+	recordEndOfBlock = 'Z'
+	// recordTrailer: byte with padding bits after the last block, verbatim gzip member trailer
+	recordTrailer = 'T'
+	// recordEnd: end of the file
+	recordEnd = 'E'
+)
+
+const (
+	minMatchLength = 3
+	maxMatchLength = 258
+	windowSize     = 1 << 15
+	// maxCandidates limits previous occurrences examined by the predictor at each match
+	maxCandidates = 128
+	hashBits      = 15
+	// keepSize is the amount of data kept in memory by the predictor before discarding data out of the window
+	keepSize = 1 << 20
+	// chunkSize limits data processed at once
+	chunkSize = 1 << 16
+)
+
+// errDataMismatch is returned if reconstruction data does not match decompressed data
+var errDataMismatch = errors.New("reconstruction data does not match decompressed data")
+
+// ReconstructionPath returns the path of the reconstruction data of the decompressed file at path
+func ReconstructionPath(path string) string {
+	return path + ReconstructionSuffix
+}
+
+// matchPredictor follows decompressed data, indexing previous occurrences of every 3-byte sequence
+// in the window, to predict matches an encoder may choose at the current position
+type matchPredictor struct {
+	r   io.Reader
+	eof bool
+	// buf holds data from position base, including the window before pos and data after it
+	buf  []byte
+	base int64
+	pos  int64
+	// head maps hashes to the last position they occurred at, prev maps positions (modulo windowSize) to
+	// the previous position with the same hash
+	head       []int64
+	prev       []int64
+	candidates []candidate
+}
+
+// candidate is a previous occurrence of data at the current position, with the length of the common prefix
+type candidate struct {
+	pos    int64
+	length int
+}
+
+// newMatchPredictor returns a matchPredictor following data read from r
+func newMatchPredictor(r io.Reader) *matchPredictor {
+	m := &matchPredictor{r: r, head: make([]int64, 1<<hashBits), prev: make([]int64, windowSize)}
+	for i := range m.head {
+		m.head[i] = -1
+	}
+	return m
+}
+
+// end returns the position after the last byte read
+func (m *matchPredictor) end() int64 {
+	return m.base + int64(len(m.buf))
+}
+
+// fill reads data up to position end, or to the end of data
+func (m *matchPredictor) fill(end int64) error {
+	if m.eof || m.end() >= end {
+		return nil
+	}
+	if drop := m.pos - windowSize - m.base; drop > keepSize {
+		m.buf = append(m.buf[:0], m.buf[drop:]...)
+		m.base += drop
+	}
+	for !m.eof && m.end() < end {
+		if cap(m.buf)-len(m.buf) < chunkSize {
+			buf := make([]byte, len(m.buf), 2*cap(m.buf)+int(end-m.end())+chunkSize)
+			copy(buf, m.buf)
+			m.buf = buf
+		}
+		n, err := m.r.Read(m.buf[len(m.buf):cap(m.buf)])
+		m.buf = m.buf[:len(m.buf)+n]
+		if err == io.EOF {
+			m.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns up to chunkSize bytes of data from the current position, at most n
+func (m *matchPredictor) next(n int64) ([]byte, error) {
+	if n > chunkSize {
+		n = chunkSize
+	}
+	if err := m.fill(m.pos + n); err != nil {
+		return nil, err
+	}
+	if m.pos+n > m.end() {
+		return nil, errDataMismatch
+	}
+	return m.buf[m.pos-m.base : m.pos-m.base+n], nil
+}
+
+// advance moves the current position n bytes forward, indexing data
+func (m *matchPredictor) advance(n int64) error {
+	for n > 0 {
+		step := n
+		if step > chunkSize {
+			step = chunkSize
+		}
+		if err := m.fill(m.pos + step + maxMatchLength); err != nil {
+			return err
+		}
+		if m.pos+step > m.end() {
+			return errDataMismatch
+		}
+		for p := m.pos; p < m.pos+step && p+minMatchLength <= m.end(); p++ {
+			h := hash3(m.buf[p-m.base:])
+			m.prev[p%windowSize] = m.head[h]
+			m.head[h] = p
+		}
+		m.pos += step
+		n -= step
+	}
+	return m.fill(m.pos + maxMatchLength)
+}
+
+// atEnd returns true if all data was followed
+func (m *matchPredictor) atEnd() (bool, error) {
+	if err := m.fill(m.pos + 1); err != nil {
+		return false, err
+	}
+	return m.pos == m.end(), nil
+}
+
+// hash3 hashes the first 3 bytes of b
+func hash3(b []byte) int {
+	return int((uint32(b[0])<<10 ^ uint32(b[1])<<5 ^ uint32(b[2])) & (1<<hashBits - 1))
+}
+
+// predict returns previous occurrences of data at the current position, most recent first. They are ranked
+// longest first, then most recent first (see rank). Data up to maxMatchLength bytes after the current position
+// must be available
+func (m *matchPredictor) predict() []candidate {
+	m.candidates = m.candidates[:0]
+	max := m.end() - m.pos
+	if max < minMatchLength {
+		return m.candidates
+	}
+	if max > maxMatchLength {
+		max = maxMatchLength
+	}
+
+	current := m.buf[m.pos-m.base : m.pos-m.base+max]
+	p := m.head[hash3(current)]
+	for i := 0; p >= 0 && m.pos-p <= windowSize && i < maxCandidates; i++ {
+		length := commonPrefixLength(m.buf[p-m.base:], current)
+		if length >= minMatchLength {
+			m.candidates = append(m.candidates, candidate{pos: p, length: length})
+		}
+		next := m.prev[p%windowSize]
+		if next >= p {
+			// overwritten by a more recent position
+			break
+		}
+		p = next
+	}
+	return m.candidates
+}
+
+// commonPrefixLength returns the length of the common prefix of a and b, b being the shortest
+func commonPrefixLength(a []byte, b []byte) int {
+	n := 0
+	for ; n+8 <= len(b); n += 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+	}
+	for ; n < len(b) && a[n] == b[n]; n++ {
+	}
+	return n
+}
+
+// rank returns the rank of candidates[i], starting from 1: longer candidates rank first, then more recent ones
+func rank(candidates []candidate, i int) int {
+	result := 1
+	for j, c := range candidates {
+		if c.length > candidates[i].length || c.length == candidates[i].length && j < i {
+			result++
+		}
+	}
+	return result
+}
+
+// ranked returns the candidate with rank r, if any
+func ranked(candidates []candidate, r int) (candidate, bool) {
+	if r < 1 || r > len(candidates) {
+		return candidate{}, false
+	}
+	if r == 1 {
+		best := candidates[0]
+		for _, c := range candidates {
+			if c.length > best.length {
+				best = c
+			}
+		}
+		return best, true
+	}
+	sorted := append([]candidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].length > sorted[j].length
+	})
+	return sorted[r-1], true
+}
+
+// recordWriter writes reconstruction data
+type recordWriter struct {
+	w       *bufio.Writer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (r *recordWriter) tag(tag byte) error {
+	return r.w.WriteByte(tag)
+}
+
+func (r *recordWriter) uvarint(v uint64) error {
+	n := binary.PutUvarint(r.scratch[:], v)
+	_, err := r.w.Write(r.scratch[:n])
+	return err
+}
+
+func (r *recordWriter) bytes(p []byte) error {
+	if err := r.uvarint(uint64(len(p))); err != nil {
+		return err
+	}
+	_, err := r.w.Write(p)
+	return err
+}
+
+// writeReconstruction parses the gzip file at sourcePath and writes reconstruction data for it to w,
+// given its decompressed version at decompressedPath
+func writeReconstruction(sourcePath string, decompressedPath string, w io.Writer) error {
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	source := bufio.NewReader(sourceFile)
+
+	data, err := os.Open(decompressedPath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	predictor := newMatchPredictor(bufio.NewReader(data))
+	if err := predictor.fill(maxMatchLength); err != nil {
+		return err
+	}
+
+	rw := &recordWriter{w: bufio.NewWriter(w)}
+	if _, err := rw.w.WriteString(reconstructionMagic); err != nil {
+		return err
+	}
+	br := &bitReader{r: source}
+
+	for {
+		header, err := readGzipHeader(source)
+		if err != nil {
+			return err
+		}
+		if err := rw.tag(recordMember); err != nil {
+			return err
+		}
+		if err := rw.bytes(header); err != nil {
+			return err
+		}
+
+		for final := false; !final; {
+			block, err := writeBlockRecords(br, rw, predictor)
+			if err != nil {
+				return err
+			}
+			final = block.final
+		}
+
+		padding, err := br.align()
+		if err != nil {
+			return err
+		}
+		trailer := make([]byte, gzipTrailerSize)
+		if _, err := io.ReadFull(source, trailer); err != nil {
+			return err
+		}
+		if err := rw.tag(recordTrailer); err != nil {
+			return err
+		}
+		if err := rw.w.WriteByte(byte(padding)); err != nil {
+			return err
+		}
+		if _, err := rw.w.Write(trailer); err != nil {
+			return err
+		}
+
+		// more members may follow, anything else is not supported
+		magic, err := source.Peek(2)
+		if err == io.EOF && len(magic) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			return errInvalidDeflate
+		}
+	}
+
+	if end, err := predictor.atEnd(); err != nil || !end {
+		return errDataMismatch
+	}
+	if err := rw.tag(recordEnd); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+// writeBlockRecords parses a deflate block from br and writes its records
+func writeBlockRecords(br *bitReader, rw *recordWriter, predictor *matchPredictor) (*blockHeader, error) {
+	var headerBits bytes.Buffer
+	br.rec = &bitWriter{w: &headerBits}
+	block, err := readBlockHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	rec := br.rec
+	br.rec = nil
+	count := rec.count
+	if err := rec.flush(); err != nil {
+		return nil, err
+	}
+	if err := rw.tag(recordBlock); err != nil {
+		return nil, err
+	}
+	if err := rw.uvarint(count); err != nil {
+		return nil, err
+	}
+	if _, err := rw.w.Write(headerBits.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if block.btype == blockStored {
+		for i := 0; i < block.storedLength; i++ {
+			if _, err := br.readBits(8); err != nil {
+				return nil, err
+			}
+		}
+		return block, predictor.advance(int64(block.storedLength))
+	}
+
+	literals := int64(0)
+	for {
+		symbol, err := block.litLen.decode(br)
+		if err != nil {
+			return nil, err
+		}
+		if symbol < endOfBlockSymbol {
+			literals++
+			continue
+		}
+
+		if literals > 0 {
+			if err := rw.tag(recordLiterals); err != nil {
+				return nil, err
+			}
+			if err := rw.uvarint(uint64(literals)); err != nil {
+				return nil, err
+			}
+			if err := predictor.advance(literals); err != nil {
+				return nil, err
+			}
+			literals = 0
+		}
+
+		if symbol == endOfBlockSymbol {
+			return block, rw.tag(recordEndOfBlock)
+		}
+
+		length, err := readLength(br, symbol)
+		if err != nil {
+			return nil, err
+		}
+		distance, err := readDistance(br, block.dist)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeMatchRecord(rw, predictor, length, distance); err != nil {
+			return nil, err
+		}
+		if err := predictor.advance(int64(length)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeMatchRecord writes a match record, relative to matches predicted at the current position
+func writeMatchRecord(rw *recordWriter, predictor *matchPredictor, length int, distance int) error {
+	candidates := predictor.predict()
+	for i, c := range candidates {
+		if predictor.pos-c.pos != int64(distance) || c.length < length {
+			continue
+		}
+		r := rank(candidates, i)
+		if r == 1 && c.length == length {
+			return rw.tag(recordPredictedMatch)
+		}
+		if err := rw.tag(recordMatch); err != nil {
+			return err
+		}
+		if err := rw.uvarint(uint64(r)); err != nil {
+			return err
+		}
+		return rw.uvarint(uint64(c.length - length))
+	}
+	if err := rw.tag(recordMatch); err != nil {
+		return err
+	}
+	if err := rw.uvarint(0); err != nil {
+		return err
+	}
+	if err := rw.uvarint(uint64(distance)); err != nil {
+		return err
+	}
+	return rw.uvarint(uint64(length))
+}
+
+// reconstruct writes to w the gzip file described by the reconstruction data at reconstructionPath,
+// given its decompressed version at decompressedPath
+func reconstruct(decompressedPath string, reconstructionPath string, w io.Writer) error {
+	recordFile, err := os.Open(reconstructionPath)
+	if err != nil {
+		return err
+	}
+	defer recordFile.Close()
+	records := bufio.NewReader(recordFile)
+	magic := make([]byte, len(reconstructionMagic))
+	if _, err := io.ReadFull(records, magic); err != nil || string(magic) != reconstructionMagic {
+		return errors.Errorf("%v is not reconstruction data", reconstructionPath)
+	}
+
+	data, err := os.Open(decompressedPath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	predictor := newMatchPredictor(bufio.NewReader(data))
+	if err := predictor.fill(maxMatchLength); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	bw := &bitWriter{w: out}
+	var block *blockHeader
+	for {
+		tag, err := records.ReadByte()
+		if err != nil {
+			return errors.Wrapf(err, "error while reading %v", reconstructionPath)
+		}
+
+		switch tag {
+		case recordMember:
+			header, err := readRecordBytes(records)
+			if err != nil {
+				return err
+			}
+			if err := bw.writeBytes(header); err != nil {
+				return err
+			}
+		case recordBlock:
+			block, err = reconstructBlockHeader(records, bw)
+			if err != nil {
+				return err
+			}
+			if block.btype == blockStored {
+				if err := reconstructLiterals(predictor, bw, nil, int64(block.storedLength)); err != nil {
+					return err
+				}
+			}
+		case recordLiterals:
+			n, err := binary.ReadUvarint(records)
+			if err != nil {
+				return err
+			}
+			if block == nil || block.btype == blockStored {
+				return errInvalidDeflate
+			}
+			if err := reconstructLiterals(predictor, bw, block.litLen, int64(n)); err != nil {
+				return err
+			}
+		case recordMatch, recordPredictedMatch:
+			if block == nil || block.btype == blockStored {
+				return errInvalidDeflate
+			}
+			length, distance, err := readMatchRecord(records, tag, predictor)
+			if err != nil {
+				return err
+			}
+			if err := writeMatch(bw, block, length, distance); err != nil {
+				return err
+			}
+			if err := predictor.advance(int64(length)); err != nil {
+				return err
+			}
+		case recordEndOfBlock:
+			if block == nil || block.btype == blockStored {
+				return errInvalidDeflate
+			}
+			if err := block.litLen.write(bw, endOfBlockSymbol); err != nil {
+				return err
+			}
+		case recordTrailer:
+			padding, err := records.ReadByte()
+			if err != nil {
+				return err
+			}
+			if err := bw.writeBits(uint32(padding), (8-bw.n)%8); err != nil {
+				return err
+			}
+			trailer := make([]byte, gzipTrailerSize)
+			if _, err := io.ReadFull(records, trailer); err != nil {
+				return err
+			}
+			if err := bw.writeBytes(trailer); err != nil {
+				return err
+			}
+		case recordEnd:
+			if end, err := predictor.atEnd(); err != nil || !end {
+				return errDataMismatch
+			}
+			if err := bw.flush(); err != nil {
+				return err
+			}
+			return out.Flush()
+		default:
+			return errors.Errorf("invalid record in %v", reconstructionPath)
+		}
+	}
+}
+
+// readRecordBytes reads a uvarint length and as many bytes
+func readRecordBytes(records *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(records)
+	if err != nil {
+		return nil, err
+	}
+	if n > chunkSize {
+		return nil, errInvalidDeflate
+	}
+	result := make([]byte, n)
+	if _, err := io.ReadFull(records, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// reconstructBlockHeader reads a block header record, writes its bits and returns the parsed header
+func reconstructBlockHeader(records *bufio.Reader, bw *bitWriter) (*blockHeader, error) {
+	count, err := binary.ReadUvarint(records)
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]byte, (count+7)/8)
+	if _, err := io.ReadFull(records, bits); err != nil {
+		return nil, err
+	}
+	// stored block headers are padded to a byte boundary of the output
+	br := &bitReader{r: bytes.NewReader(bits), offset: uint64(bw.n)}
+	block, err := readBlockHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if br.offset-uint64(bw.n) != count {
+		return nil, errInvalidDeflate
+	}
+	for _, b := range bits[:count/8] {
+		if err := bw.writeBits(uint32(b), 8); err != nil {
+			return nil, err
+		}
+	}
+	if count%8 != 0 {
+		return block, bw.writeBits(uint32(bits[count/8]), uint(count%8))
+	}
+	return block, nil
+}
+
+// reconstructLiterals writes n bytes of data as literals with litLen, or verbatim if litLen is nil
+func reconstructLiterals(predictor *matchPredictor, bw *bitWriter, litLen *huffman, n int64) error {
+	for n > 0 {
+		p, err := predictor.next(n)
+		if err != nil {
+			return err
+		}
+		for _, b := range p {
+			if litLen == nil {
+				err = bw.writeBits(uint32(b), 8)
+			} else {
+				err = litLen.write(bw, int(b))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := predictor.advance(int64(len(p))); err != nil {
+			return err
+		}
+		n -= int64(len(p))
+	}
+	return nil
+}
+
+// readMatchRecord reads a match record with tag and returns the length and distance of the match
+func readMatchRecord(records *bufio.Reader, tag byte, predictor *matchPredictor) (int, int, error) {
+	if tag == recordPredictedMatch {
+		c, ok := ranked(predictor.predict(), 1)
+		if !ok {
+			return 0, 0, errDataMismatch
+		}
+		return c.length, int(predictor.pos - c.pos), nil
+	}
+
+	r, err := binary.ReadUvarint(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if r == 0 {
+		distance, err := binary.ReadUvarint(records)
+		if err != nil {
+			return 0, 0, err
+		}
+		length, err := binary.ReadUvarint(records)
+		if err != nil {
+			return 0, 0, err
+		}
+		if distance > windowSize || length > maxMatchLength {
+			return 0, 0, errInvalidDeflate
+		}
+		return int(length), int(distance), nil
+	}
+
+	delta, err := binary.ReadUvarint(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	c, ok := ranked(predictor.predict(), int(r))
+	if !ok || delta > uint64(c.length) {
+		return 0, 0, errDataMismatch
+	}
+	return c.length - int(delta), int(predictor.pos - c.pos), nil
+}
+
+// reconstructTo writes to destinationPath the gzip file described by the reconstruction data of the decompressed
+// file at sourcePath
+func reconstructTo(sourcePath string, destinationPath string) error {
+	destination, err := os.Create(destinationPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not open to compress: %v", destinationPath)
+	}
+	if err := reconstruct(sourcePath, ReconstructionPath(sourcePath), destination); err != nil {
+		closeAndLog(destination)
+		return errors.Wrapf(err, "error while reconstructing: %v", sourcePath)
+	}
+	if err := destination.Close(); err != nil {
+		return errors.Wrapf(err, "error while closing: %v", destinationPath)
+	}
+	return nil
+}
+
+// findGzipReconstruction writes reconstruction data for the gzip file at sourcePath, given its decompressed
+// version at decompressedPath, to reconstructionPath. Returns true if it rebuilds sourcePath exactly, otherwise
+// reconstructionPath is removed
+func findGzipReconstruction(sourcePath string, decompressedPath string, reconstructionPath string) (bool, error) {
+	ok, err := writeAndCheckReconstruction(sourcePath, decompressedPath, reconstructionPath)
+	if !ok {
+		removeAndLog(reconstructionPath)
+	}
+	if err == errInvalidDeflate || err == errDataMismatch || err == io.ErrUnexpectedEOF || err == io.EOF {
+		// not reproducible, situation normal
+		return false, nil
+	}
+	return ok, err
+}
+
+// writeAndCheckReconstruction writes reconstruction data to reconstructionPath and checks it rebuilds sourcePath
+func writeAndCheckReconstruction(sourcePath string, decompressedPath string, reconstructionPath string) (bool, error) {
+	f, err := os.Create(reconstructionPath)
+	if err != nil {
+		return false, err
+	}
+	err = writeReconstruction(sourcePath, decompressedPath, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return false, err
+	}
+	defer source.Close()
+	h1 := sha512.New()
+	if _, err := io.Copy(h1, source); err != nil {
+		return false, err
+	}
+
+	h2 := sha512.New()
+	if err := reconstruct(decompressedPath, reconstructionPath, h2); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h1.Sum(nil), h2.Sum(nil)), nil
+}
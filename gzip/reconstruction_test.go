@@ -0,0 +1,164 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// deflate block types, as in the BTYPE field of block headers
+const (
+	storedBlock  = 0
+	fixedBlock   = 1
+	dynamicBlock = 2
+)
+
+// testData returns deterministic text of about size bytes, with enough repetition to produce matches
+func testData(size int) []byte {
+	words := strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut labore et dolore magna aliqua")
+	random := rand.New(rand.NewSource(42))
+	var b bytes.Buffer
+	for b.Len() < size {
+		b.WriteString(words[random.Intn(len(words))])
+		if random.Intn(10) == 0 {
+			b.WriteByte('\n')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	return b.Bytes()
+}
+
+// goGzip compresses data with compress/gzip at level
+func goGzip(t *testing.T, data []byte, level int) []byte {
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// gnuGzip compresses data with GNU gzip and flag, skipping the test if gzip is not available
+func gnuGzip(t *testing.T, data []byte, flag string) []byte {
+	path, err := exec.LookPath("gzip")
+	if err != nil {
+		t.Skip("gzip not found")
+	}
+	cmd := exec.Command(path, "-n", "-c", flag)
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// firstBlockType returns the type of the first deflate block of gz, which must have a plain 10-byte header
+func firstBlockType(gz []byte) int {
+	return int(gz[10]>>1) & 3
+}
+
+func TestReconstruction(t *testing.T) {
+	data := testData(256 * 1024)
+	short := bytes.Repeat([]byte("booster "), 16)
+
+	cases := []struct {
+		name      string
+		gzip      func(t *testing.T) []byte
+		blockType int
+	}{
+		{"stored blocks", func(t *testing.T) []byte { return goGzip(t, data, gzip.NoCompression) }, storedBlock},
+		{"fixed blocks", func(t *testing.T) []byte { return goGzip(t, short, gzip.DefaultCompression) }, fixedBlock},
+		{"dynamic blocks", func(t *testing.T) []byte { return goGzip(t, data, gzip.DefaultCompression) }, dynamicBlock},
+		{"huffman only", func(t *testing.T) []byte { return goGzip(t, data, gzip.HuffmanOnly) }, dynamicBlock},
+		{"GNU gzip -1", func(t *testing.T) []byte { return gnuGzip(t, data, "-1") }, -1},
+		{"GNU gzip -6", func(t *testing.T) []byte { return gnuGzip(t, data, "-6") }, -1},
+		{"GNU gzip -9", func(t *testing.T) []byte { return gnuGzip(t, data, "-9") }, -1},
+		{"multiple members", func(t *testing.T) []byte {
+			return append(goGzip(t, data[:1000], gzip.DefaultCompression), gnuGzip(t, data[1000:], "-9")...)
+		}, -1},
+		{"empty input", func(t *testing.T) []byte { return goGzip(t, nil, gzip.DefaultCompression) }, -1},
+		{"empty input, GNU gzip", func(t *testing.T) []byte { return gnuGzip(t, nil, "-6") }, -1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			original := c.gzip(t)
+			if c.blockType >= 0 && firstBlockType(original) != c.blockType {
+				t.Fatalf("first block has type %v, expected %v", firstBlockType(original), c.blockType)
+			}
+
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "layer.gz")
+			decompressedPath := filepath.Join(dir, "layer")
+			reconstructionPath := ReconstructionPath(decompressedPath)
+			if err := os.WriteFile(sourcePath, original, 0600); err != nil {
+				t.Fatal(err)
+			}
+			r, err := gzip.NewReader(bytes.NewReader(original))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(decompressedPath, decompressed, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			ok, err := findGzipReconstruction(sourcePath, decompressedPath, reconstructionPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("no reconstruction found")
+			}
+
+			var reconstructed bytes.Buffer
+			if err := reconstruct(decompressedPath, reconstructionPath, &reconstructed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reconstructed.Bytes(), original) {
+				t.Fatalf("reconstructed %v bytes differ from the original %v bytes", reconstructed.Len(), len(original))
+			}
+		})
+	}
+}
+
+func TestReconstructionMismatch(t *testing.T) {
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "layer.gz")
+	decompressedPath := filepath.Join(dir, "layer")
+	reconstructionPath := ReconstructionPath(decompressedPath)
+	if err := os.WriteFile(sourcePath, goGzip(t, testData(4096), gzip.DefaultCompression), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(decompressedPath, testData(1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := findGzipReconstruction(sourcePath, decompressedPath, reconstructionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("reconstruction found for different decompressed data")
+	}
+	if _, err := os.Stat(reconstructionPath); !os.IsNotExist(err) {
+		t.Fatal("reconstruction data not removed")
+	}
+}
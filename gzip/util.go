@@ -12,13 +12,167 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 )
 
-// Suffix is the name appended to files decompressed by this module
+// Suffix is the name appended to gzip files decompressed by this module
 const Suffix = "_UNGZIPPED_BY_BOOSTER"
 
-// DecompressWalking decompresses "recompressible" gzip files found in root and subdirectories
-func DecompressWalking(root string) (*util.FileSet, error) {
+// partialSuffix is appended to files being decompressed, which are renamed once complete and verified
+const partialSuffix = Suffix + "_PARTIAL"
+
+// recompressibilityReader decompresses a file, checking whether it can be recompressed transparently
+type recompressibilityReader interface {
+	io.ReadCloser
+	TransparentlyRecompressible() bool
+	// Differs returns true as soon as the file is known not to be recompressible
+	Differs() bool
+}
+
+// errNotRecompressible is returned by abortingReader once the file is known not to be recompressible
+var errNotRecompressible = errors.New("not recompressible")
+
+// abortingReader stops reading from a recompressibilityReader once the file is known not to be recompressible
+type abortingReader struct {
+	recompressibilityReader
+}
+
+// Read implements io.Reader
+func (r abortingReader) Read(p []byte) (int, error) {
+	if r.Differs() {
+		return 0, errNotRecompressible
+	}
+	return r.recompressibilityReader.Read(p)
+}
+
+// recipeReader is a recompressibilityReader which also returns the recipe reproducing the file
+type recipeReader interface {
+	Recipe() *Recipe
+}
+
+// recipeOf returns the recipe reproducing the file read by r, or nil if there is none
+func recipeOf(r recompressibilityReader) *Recipe {
+	if rr, ok := r.(recipeReader); ok {
+		return rr.Recipe()
+	}
+	return nil
+}
+
+// headerReader is a recompressibilityReader whose header has to be restored when recompressing
+type headerReader interface {
+	Header() *gzip.Header
+}
+
+// headerOf returns the header of the stream read by r, or nil if its format has none
+func headerOf(r recompressibilityReader) *gzip.Header {
+	if h, ok := r.(headerReader); ok {
+		return h.Header()
+	}
+	return nil
+}
+
+// format is a compression format files are decompressed from and recompressed to
+type format struct {
+	// suffix is appended to decompressed files, partialSuffix to files being decompressed
+	suffix        string
+	partialSuffix string
+	newReader     func(r io.Reader) (recompressibilityReader, error)
+	// findReconstruction, if not nil, writes reconstruction data rebuilding files no Recipe reproduces
+	findReconstruction func(sourcePath string, decompressedPath string, reconstructionPath string) (bool, error)
+}
+
+// formats lists supported compression formats, in the order decompression is attempted
+var formats = []format{
+	{
+		suffix:        Suffix,
+		partialSuffix: partialSuffix,
+		newReader: func(r io.Reader) (recompressibilityReader, error) {
+			rreader, err := newRecompressibilityReader(r, append([]Recipe{defaultRecipe}, gzipRecipes...))
+			if err != nil {
+				return nil, err
+			}
+			return rreader, nil
+		},
+		findReconstruction: findGzipReconstruction,
+	},
+	{
+		suffix:        ZstdSuffix,
+		partialSuffix: zstdPartialSuffix,
+		newReader: func(r io.Reader) (recompressibilityReader, error) {
+			rreader, err := NewZstdRecompressibilityReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return rreader, nil
+		},
+	},
+}
+
+// isOtherFormat returns true if a recompressibilityReader could not be created because input is in a
+// different format, empty or too short
+func isOtherFormat(err error) bool {
+	return err == gzip.ErrHeader || err == ErrNotZstd || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// formatOf returns the format of a file decompressed by this module, given its path
+func formatOf(path string) (format, bool) {
+	for _, f := range formats {
+		if strings.HasSuffix(path, f.suffix) {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+// IsDecompressed returns true if path is the path of a file decompressed by this module
+func IsDecompressed(path string) bool {
+	_, ok := formatOf(path)
+	return ok
+}
+
+// CompressedPath returns the path of the file a decompressed file was decompressed from
+// paths of files which were not decompressed are returned unchanged
+func CompressedPath(path string) string {
+	if f, ok := formatOf(path); ok {
+		return strings.TrimSuffix(path, f.suffix)
+	}
+	return path
+}
+
+// DecompressedPaths returns the paths a file can be decompressed to, one per format
+func DecompressedPaths(path string) []string {
+	result := []string{}
+	for _, f := range formats {
+		result = append(result, path+f.suffix)
+	}
+	return result
+}
+
+// isPartial returns true if path is the path of a file being decompressed
+func isPartial(path string) bool {
+	for _, f := range formats {
+		if strings.HasSuffix(path, f.partialSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecompressWalking decompresses "recompressible" gzip and zstd files found in root and subdirectories
+// if reconstruct is true, any gzip file is decompressed along with reconstruction data
+// blobs verdicts has as not recompressible are skipped, and new verdicts are added to it (if not nil)
+func DecompressWalking(root string, reconstruct bool, verdicts *Verdicts) (*util.FileSet, error) {
+	paths, err := FilesToDecompress(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return Decompress(paths, reconstruct, verdicts), nil
+}
+
+// FilesToDecompress returns files found in root and subdirectories which DecompressWalking would attempt to
+// decompress, without changing anything
+func FilesToDecompress(root string) (*util.FileSet, error) {
 	paths := util.NewFileSet()
 	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
 		// skip the booster-specific dir altogether
@@ -29,8 +183,8 @@ func DecompressWalking(root string) (*util.FileSet, error) {
 		if !d.Type().IsRegular() {
 			return nil
 		}
-		// skip already decompressed files (by name)
-		if strings.HasSuffix(p, Suffix) {
+		// skip already (or partially) decompressed files, recipes and reconstruction data (by name)
+		if IsDecompressed(p) || isPartial(p) || IsSidecar(p) {
 			return nil
 		}
 
@@ -42,109 +196,199 @@ func DecompressWalking(root string) (*util.FileSet, error) {
 		return nil, err
 	}
 
-	return Decompress(paths), nil
+	return paths, nil
 }
 
-// Decompress decompresses "recompressible" gzip files in the specified map
+// Decompress decompresses "recompressible" gzip and zstd files in the specified map
+// if reconstruct is true, any gzip file is decompressed along with reconstruction data (see reconstruction.go)
+// blobs verdicts has as not recompressible are skipped, and new verdicts are added to it (if not nil)
 // uses up to runtime.NumCPU()*2 goroutines concurrently, one per file
-// returns a map of decompressed or unchanged paths
-func Decompress(files *util.FileSet) *util.FileSet {
+// returns a map of decompressed or unchanged paths, plus recipes and reconstruction data of decompressed files
+func Decompress(files *util.FileSet, reconstruct bool, verdicts *Verdicts) *util.FileSet {
 	log.Info().Msg("Decompressing layers...")
 
-	processedPaths := make(chan string, runtime.NumCPU()*2)
+	processedPaths := make(chan []string, runtime.NumCPU()*2)
 	files.Walk(func(path string) {
-		uncompressedPath := path + Suffix
 		go func() {
-			if decompress(path, uncompressedPath) {
-				// decompression was successful, return path to decompressed file
-				processedPaths <- uncompressedPath
-			} else {
-				// decompression was NOT successful, return the original path
-				processedPaths <- path
-			}
+			// return path to decompressed file if decompression was successful, the original path otherwise
+			processedPaths <- decompressAny(path, reconstruct, verdicts)
 		}()
 	})
 
 	// make a map of all processed paths
 	result := util.NewFileSet()
 	for i := 0; i < files.Len(); i++ {
-		processedPath := <-processedPaths
-		result.Add(processedPath)
+		for _, p := range <-processedPaths {
+			// add also parent dirs
+			result.AddWithParents(p)
+		}
+	}
 
-		// add also parent dirs
-		for processedPath != filepath.Dir(processedPath) {
-			processedPath = filepath.Dir(processedPath)
-			result.Add(processedPath)
+	return result
+}
+
+// decompressAny decompresses a file in any supported format, if recompressible, unless verdicts has it
+// as not recompressible. The outcome is recorded in verdicts, unless there were errors (which are logged)
+// returns the path of the decompressed file and of its sidecars, if any, or path if it could not be decompressed
+func decompressAny(path string, reconstruct bool, verdicts *Verdicts) []string {
+	if verdicts.notRecompressible(path, reconstruct) {
+		return []string{path}
+	}
+	for _, f := range formats {
+		ok, err := decompress(path, path+f.suffix, f, reconstruct)
+		if err != nil {
+			log.Error().Str("path", path).Err(err).Msg("error while attempting decompression")
+			return []string{path}
+		}
+		if ok {
+			verdicts.recordDecompressed(path, path+f.suffix)
+			return WithSidecars(path + f.suffix)
 		}
 	}
+	verdicts.recordNotRecompressible(path, reconstruct)
+	return []string{path}
+}
 
+// WithSidecars returns the path of a decompressed file and the paths of its recipe, header and reconstruction data, if any
+func WithSidecars(path string) []string {
+	result := []string{path}
+	for _, p := range []string{RecipePath(path), HeaderPath(path), ReconstructionPath(path)} {
+		if _, err := os.Stat(p); err == nil {
+			result = append(result, p)
+		}
+	}
 	return result
 }
 
-// decompress decompresses a gzip file, if recompressible, into destinationPath
+// decompress decompresses a file in format f, if recompressible, into destinationPath
+// destinationPath is only created once decompression is complete and recompressibility verified
+// if reconstruct is true, files are also recompressible via reconstruction data
 // returns true in case decompression was successful, false if the decompression could not happen
-// (or could happen but without recompressibility guarantees)
-// any errors are logged and not returned
-func decompress(sourcePath string, destinationPath string) bool {
+// (or could happen but without recompressibility guarantees), or an error if it could not be determined
+func decompress(sourcePath string, destinationPath string, f format, reconstruct bool) (bool, error) {
 	if _, err := os.Stat(destinationPath); err == nil {
-		// file has been decompressed already
-		return true
+		// file has been decompressed already, possibly by a run with reconstruction
+		if _, err := os.Stat(ReconstructionPath(destinationPath)); err == nil {
+			return reconstruct, nil
+		}
+		_, version, err := readRecipe(destinationPath)
+		if err != nil {
+			return false, errors.Wrap(err, "error while reading recipe")
+		}
+		if version == EncoderVersion {
+			return true, nil
+		}
+		// decompressed by a booster with a different encoder, which this one cannot recompress with
+		log.Info().Str("path", sourcePath).Str("encoder_version", version).Msg("decompressed with a different encoder version, decompressing again")
+		for _, p := range WithSidecars(destinationPath) {
+			if err := os.Remove(p); err != nil {
+				return false, errors.Wrap(err, "error while removing stale decompressed file")
+			}
+		}
 	}
 
 	source, err := os.Open(sourcePath)
 	if err != nil {
-		log.Error().Str("path", sourcePath).Err(err).Msg("could not open to attempt decompression")
-		return false
+		return false, errors.Wrap(err, "could not open to attempt decompression")
 	}
 
-	rreader, err := NewRecompressibilityReader(source)
-	if err == gzip.ErrHeader || err == io.EOF {
-		// not a gzip or even empty, situation normal
+	rreader, err := f.newReader(source)
+	if isOtherFormat(err) {
+		// not in this format, even empty or shorter than a header, situation normal
 		closeAndLog(source)
-		return false
+		return false, nil
 	}
 	if err != nil {
-		log.Error().Str("path", sourcePath).Err(err).Msg("error while initing decompression")
 		closeAndLog(source)
-		return false
+		return false, errors.Wrap(err, "error while initing decompression")
 	}
 
-	destination, err := os.Create(destinationPath)
+	partialPath := strings.TrimSuffix(destinationPath, f.suffix) + f.partialSuffix
+	destination, err := os.Create(partialPath)
 	if err != nil {
-		log.Error().Str("path", destinationPath).Err(err).Msg("could not create temporary file to attempt decompression")
 		closeAndLog(source)
-		return false
+		return false, errors.Wrap(err, "could not create temporary file to attempt decompression")
 	}
 
-	_, err = io.Copy(destination, rreader)
+	var reader io.Reader = rreader
+	if !reconstruct || f.findReconstruction == nil {
+		// without reconstruction data, stop as soon as the file is known not to be recompressible
+		reader = abortingReader{rreader}
+	}
+	_, err = io.Copy(destination, reader)
+	if err == errNotRecompressible {
+		// situation normal, roll back
+		log.Debug().Str("path", sourcePath).Msg("not recompressible, decompression stopped early")
+		closeAndLog(destination)
+		removeAndLog(partialPath)
+		if err := rreader.Close(); err != nil {
+			log.Error().Str("path", sourcePath).Err(err).Msg("error while closing recompressibility reader")
+		}
+		closeAndLog(source)
+		return false, nil
+	}
 	if err != nil {
-		log.Error().Str("path", sourcePath).Err(err).Msg("error while decompressing")
 		closeAndLog(destination)
-		removeAndLog(destinationPath)
+		removeAndLog(partialPath)
 		closeAndLog(source)
-		return false
+		return false, errors.Wrap(err, "error while decompressing")
 	}
 
 	err = rreader.Close()
 	if err != nil {
-		log.Error().Str("path", sourcePath).Err(err).Msg("error while closing recompressibility reader")
 		closeAndLog(destination)
-		removeAndLog(destinationPath)
+		removeAndLog(partialPath)
 		closeAndLog(source)
-		return false
+		return false, errors.Wrap(err, "error while closing recompressibility reader")
 	}
 
 	closeAndLog(destination)
 	closeAndLog(source)
 
-	if !rreader.TransparentlyRecompressible() {
+	recompressible, err := recompressibleWithSidecar(sourcePath, partialPath, destinationPath, f, recipeOf(rreader), headerOf(rreader), reconstruct)
+	if err != nil || !recompressible {
 		// decompression worked but the result can't be compressed back
 		// this archive can't be trusted, roll back
-		removeAndLog(destinationPath)
-		return false
+		removeAndLog(partialPath)
+		return false, err
+	}
+
+	if err := os.Rename(partialPath, destinationPath); err != nil {
+		removeAndLog(partialPath)
+		return false, errors.Wrap(err, "error while renaming decompressed file")
+	}
+
+	return true, nil
+}
+
+// recompressibleWithSidecar returns true if sourcePath can be rebuilt from partialPath with recipe and header or,
+// if reconstruct is true, with reconstruction data, written next to destinationPath
+func recompressibleWithSidecar(sourcePath string, partialPath string, destinationPath string, f format, recipe *Recipe, header *gzip.Header, reconstruct bool) (bool, error) {
+	if recipe != nil {
+		if *recipe != defaultRecipe && *recipe != zstdRecipe {
+			log.Debug().Str("path", sourcePath).Str("encoder", recipe.Encoder).Int("compression", recipe.Level).Msg("found recipe")
+		}
+		if err := writeRecipe(destinationPath, recipe); err != nil {
+			return false, errors.Wrap(err, "error while writing recipe")
+		}
+		if err := writeHeader(destinationPath, header); err != nil {
+			removeAndLog(RecipePath(destinationPath))
+			return false, errors.Wrap(err, "error while writing gzip header")
+		}
+		return true, nil
 	}
 
-	return true
+	if !reconstruct || f.findReconstruction == nil {
+		return false, nil
+	}
+	ok, err := f.findReconstruction(sourcePath, partialPath, ReconstructionPath(destinationPath))
+	if err != nil {
+		return false, errors.Wrap(err, "error while writing reconstruction data")
+	}
+	if ok {
+		log.Debug().Str("path", sourcePath).Msg("wrote reconstruction data")
+	}
+	return ok, nil
 }
 
 // closeAndLog closes a file logging any errors
@@ -162,27 +406,38 @@ func removeAndLog(path string) {
 	}
 }
 
-// RecompressAllIn recompresses any gzip files decompressed by Decompress
+// RecompressAllIn recompresses any gzip and zstd files decompressed by Decompress
+// returns an error listing files that could not be recompressed, if any
 func RecompressAllIn(basePath string) error {
 	log.Info().Msg("Recompressing layer files...")
+	var mutex sync.Mutex
+	failed := []string{}
 	pool := pond.New(runtime.NumCPU(), 1000)
 	err := filepath.WalkDir(basePath, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		// skip any file other than those created by Decompress
-		if !strings.HasSuffix(p, Suffix) {
+		f, ok := formatOf(p)
+		if !ok {
 			return nil
 		}
 		// skip already compressed
-		compressedPath := strings.TrimSuffix(p, Suffix)
+		compressedPath := strings.TrimSuffix(p, f.suffix)
 		if _, err := os.Stat(compressedPath); err == nil {
 			return nil
 		}
 
 		pool.Submit(func() {
 			if err := compress(p, compressedPath); err != nil {
-				log.Error().Err(err)
+				log.Error().Str("path", p).Err(err).Msg("Recompression failed")
+				// a partial file would be taken as already compressed by later runs
+				if _, err := os.Stat(compressedPath); err == nil {
+					removeAndLog(compressedPath)
+				}
+				mutex.Lock()
+				failed = append(failed, p)
+				mutex.Unlock()
 			}
 		})
 		return nil
@@ -193,47 +448,73 @@ func RecompressAllIn(basePath string) error {
 
 	pool.StopAndWait()
 	if pool.FailedTasks() != 0 {
-		return errors.Errorf("Error while decompressing files in %v", basePath)
+		return errors.Errorf("Error while recompressing files in %v", basePath)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("%v files in %v could not be recompressed: %v", len(failed), basePath, strings.Join(failed, ", "))
 	}
 	return nil
 }
 
-// compress gzip-compresses a file
+// compress compresses a decompressed file following its reconstruction data or recipe, and restoring
+// its gzip header if not default. Files decompressed by a booster with a different EncoderVersion are refused
 func compress(sourcePath string, destinationPath string) error {
+	if _, err := os.Stat(ReconstructionPath(sourcePath)); err == nil {
+		return reconstructTo(sourcePath, destinationPath)
+	}
+
+	recipe, version, err := readRecipe(sourcePath)
+	if err != nil {
+		return err
+	}
+	if recipe == nil {
+		return errors.Errorf("%v has no recipe: it was not decompressed by this booster version and would not be recompressed to the same bytes", sourcePath)
+	}
+	if version != EncoderVersion {
+		return errors.Errorf("%v was decompressed with encoder version %v, but this booster has %v: it would not be recompressed to the same bytes", sourcePath, version, EncoderVersion)
+	}
+	header, err := readHeader(sourcePath)
+	if err != nil {
+		return err
+	}
+
 	source, err := os.Open(sourcePath)
 	if err != nil {
 		return errors.Wrapf(err, "could not open to compress: %v", sourcePath)
 	}
+	defer closeAndLog(source)
 
 	destination, err := os.Create(destinationPath)
 	if err != nil {
 		return errors.Wrapf(err, "could not open to compress: %v", destinationPath)
 	}
 
-	gzDestination := gzip.NewWriter(destination)
+	gzDestination, err := recipe.newWriter(destination, header)
+	if err != nil {
+		closeAndLog(destination)
+		return errors.Wrapf(err, "could not open to compress: %v", destinationPath)
+	}
 
 	_, err = io.Copy(gzDestination, source)
 	if err != nil {
+		closeAndLog(destination)
 		return errors.Wrapf(err, "error while compressing: %v", sourcePath)
 	}
 
 	err = gzDestination.Close()
 	if err != nil {
+		closeAndLog(destination)
 		return errors.Wrapf(err, "error while closing: %v", destinationPath)
 	}
 	err = destination.Close()
 	if err != nil {
 		return errors.Wrapf(err, "error while closing: %v", destinationPath)
 	}
-	err = source.Close()
-	if err != nil {
-		return errors.Wrapf(err, "error while closing: %v", sourcePath)
-	}
 
 	return nil
 }
 
-// Clean deletes decompressed files
+// Clean deletes decompressed (and partially decompressed) files, their recipes, headers and reconstruction data
 func Clean(path string) error {
 	log.Info().Str("path", path).Msg("Cleaning")
 	var toRemove []string
@@ -242,7 +523,7 @@ func Clean(path string) error {
 			return err
 		}
 
-		if strings.HasSuffix(p, Suffix) {
+		if IsDecompressed(p) || isPartial(p) || IsSidecar(p) {
 			toRemove = append(toRemove, p)
 		}
 		return nil
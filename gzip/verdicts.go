@@ -0,0 +1,153 @@
+package gzip
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Verdict is the outcome of decompressing a blob
+type Verdict struct {
+	Recompressible bool
+	// Recipe reproduces the blob, unless reconstruction data does
+	Recipe *Recipe `json:",omitempty"`
+	// UncompressedSize is the size of the decompressed blob, if recompressible
+	UncompressedSize int64 `json:",omitempty"`
+	// Reconstruct is true if the verdict was reached with reconstruction data allowed
+	Reconstruct bool `json:",omitempty"`
+}
+
+// Verdicts is an on-disk index of verdicts by blob digest, so that blobs found not recompressible are not
+// decompressed again. Only blobs with a digest in their path are indexed, see blobDigest.
+// A nil *Verdicts indexes nothing
+type Verdicts struct {
+	path  string
+	mutex sync.Mutex
+
+	// EncoderVersion is the EncoderVersion verdicts were reached with
+	EncoderVersion string
+	Verdicts       map[digest.Digest]Verdict
+}
+
+// LoadVerdicts loads the index at path, if any, otherwise starts a new one
+// verdicts reached with a different EncoderVersion are discarded
+func LoadVerdicts(path string) (*Verdicts, error) {
+	v := &Verdicts{path: path, EncoderVersion: EncoderVersion, Verdicts: map[digest.Digest]Verdict{}}
+
+	bytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while reading verdicts %v", path)
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		return nil, errors.Wrapf(err, "Error while parsing verdicts %v", path)
+	}
+	if v.EncoderVersion != EncoderVersion || v.Verdicts == nil {
+		v.EncoderVersion = EncoderVersion
+		v.Verdicts = map[digest.Digest]Verdict{}
+	}
+	return v, nil
+}
+
+// Save writes the index to its path
+func (v *Verdicts) Save() error {
+	if v == nil {
+		return nil
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "Error while marshalling verdicts")
+	}
+	if err := os.MkdirAll(filepath.Dir(v.path), 0700); err != nil {
+		return errors.Wrapf(err, "Error while creating directory for verdicts %v", v.path)
+	}
+	tempPath := v.path + ".tmp"
+	if err := os.WriteFile(tempPath, bytes, 0600); err != nil {
+		return errors.Wrapf(err, "Error while writing verdicts %v", tempPath)
+	}
+	if err := os.Rename(tempPath, v.path); err != nil {
+		return errors.Wrapf(err, "Error while writing verdicts %v", v.path)
+	}
+	return nil
+}
+
+// Clear discards all verdicts
+func (v *Verdicts) Clear() {
+	if v == nil {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.Verdicts = map[digest.Digest]Verdict{}
+}
+
+// notRecompressible returns true if the blob at path was found not recompressible, with reconstruction data
+// if reconstruct is true
+func (v *Verdicts) notRecompressible(path string, reconstruct bool) bool {
+	d, ok := blobDigest(path)
+	if v == nil || !ok {
+		return false
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	verdict, ok := v.Verdicts[d]
+	return ok && !verdict.Recompressible && (verdict.Reconstruct || !reconstruct)
+}
+
+// recordDecompressed records that the blob at path was decompressed to decompressedPath
+func (v *Verdicts) recordDecompressed(path string, decompressedPath string) {
+	d, ok := blobDigest(path)
+	if v == nil || !ok {
+		return
+	}
+	verdict := Verdict{Recompressible: true}
+	// sidecars were just written, errors would have been reported
+	verdict.Recipe, _, _ = readRecipe(decompressedPath)
+	if info, err := os.Stat(decompressedPath); err == nil {
+		verdict.UncompressedSize = info.Size()
+	}
+	if _, err := os.Stat(ReconstructionPath(decompressedPath)); err == nil {
+		verdict.Reconstruct = true
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.Verdicts[d] = verdict
+}
+
+// recordNotRecompressible records that the blob at path was not recompressible, with reconstruction data
+// if reconstruct is true
+func (v *Verdicts) recordNotRecompressible(path string, reconstruct bool) {
+	d, ok := blobDigest(path)
+	if v == nil || !ok {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.Verdicts[d] = Verdict{Recompressible: false, Reconstruct: reconstruct}
+}
+
+// blobDigest returns the digest of the blob at path, if its path contains it: "blobs/<algorithm>/<hex>"
+// in OCI layouts, "blobs/<algorithm>/<hex prefix>/<hex>/data" in registry storage
+func blobDigest(path string) (digest.Digest, bool) {
+	name := filepath.Base(path)
+	dir := filepath.Dir(path)
+	if name == "data" {
+		name = filepath.Base(dir)
+		dir = filepath.Dir(filepath.Dir(dir))
+	}
+	d := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(dir)), name)
+	if d.Validate() != nil {
+		return "", false
+	}
+	return d, true
+}
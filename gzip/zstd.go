@@ -0,0 +1,115 @@
+package gzip
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// ZstdSuffix is the name appended to zstd files decompressed by this module
+const ZstdSuffix = "_UNZSTDED_BY_BOOSTER"
+
+// zstdPartialSuffix is appended to zstd files being decompressed, which are renamed once complete and verified
+const zstdPartialSuffix = ZstdSuffix + "_PARTIAL"
+
+// zstdMagic starts every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ErrNotZstd is returned by NewZstdRecompressibilityReader if its input does not start with a zstd frame
+var ErrNotZstd = errors.New("not a zstd stream")
+
+// newZstdWriter returns the zstd encoder used to recompress files. It has default settings, like the
+// encoder used by containers/image to compress zstd layers, pinned so that changes of defaults are not missed.
+// Concurrency does not affect streamed output
+func newZstdWriter(w io.Writer) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.SpeedDefault),
+		zstd.WithWindowSize(8<<20),
+		zstd.WithEncoderCRC(true),
+		zstd.WithAllLitEntropyCompression(true),
+		zstd.WithNoEntropyCompression(false),
+		zstd.WithZeroFrames(false),
+		zstd.WithEncoderPadding(1),
+		zstd.WithLowerEncoderMem(false),
+		zstd.WithEncoderConcurrency(1),
+	)
+}
+
+// ZstdRecompressibilityReader is the zstd counterpart of RecompressibilityReader: a zstd reader which checks,
+// while reading, whether the file can be later recompressed resulting in the exact same binary.
+// This is currently the case if the zstd stream was created with the klauspost/compress encoder version
+// booster is built with and default settings (as containers/image does).
+// Recompressed bytes are compared with the original ones as soon as they are available, see Differs
+type ZstdRecompressibilityReader struct {
+	reader   *zstd.Decoder
+	writer   *zstd.Encoder
+	tee2     io.Reader
+	comparer *streamComparer
+}
+
+// NewZstdRecompressibilityReader returns a ZstdRecompressibilityReader which also checks whether its contents can be recompressed transparently
+// returns ErrNotZstd if r does not start with a zstd frame
+func NewZstdRecompressibilityReader(r io.Reader) (*ZstdRecompressibilityReader, error) {
+	// r -> tee1 -> comparer
+	//       |----> reader -> tee2 -> writer -> comparer
+	//                         |----> caller
+
+	comparer := &streamComparer{}
+	tee1 := bufio.NewReader(io.TeeReader(r, comparer.originalWriter()))
+	magic, err := tee1.Peek(len(zstdMagic))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return nil, ErrNotZstd
+	}
+
+	reader, err := zstd.NewReader(tee1)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newZstdWriter(comparer.recompressedWriter())
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	tee2 := io.TeeReader(reader, writer)
+
+	return &ZstdRecompressibilityReader{tee2: tee2, reader: reader, writer: writer, comparer: comparer}, nil
+}
+
+// Read implements io.Reader
+func (r ZstdRecompressibilityReader) Read(p []byte) (n int, err error) {
+	return r.tee2.Read(p)
+}
+
+// Close implements io.Closer
+func (r ZstdRecompressibilityReader) Close() error {
+	r.reader.Close()
+	return r.writer.Close()
+}
+
+// Differs returns true as soon as bytes read so far, once recompressed with newZstdWriter, are known to differ
+// from the original archive, even before reading is complete
+func (r ZstdRecompressibilityReader) Differs() bool {
+	return r.comparer.Differs()
+}
+
+// TransparentlyRecompressible returns true if bytes read so far, once recompressed with newZstdWriter,
+// reconstruct the original archive exactly
+func (r ZstdRecompressibilityReader) TransparentlyRecompressible() bool {
+	return r.comparer.Equal()
+}
+
+// Recipe returns zstdRecipe if the archive is TransparentlyRecompressible, nil otherwise
+func (r ZstdRecompressibilityReader) Recipe() *Recipe {
+	if !r.TransparentlyRecompressible() {
+		return nil
+	}
+	recipe := zstdRecipe
+	return &recipe
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,7 +9,9 @@ import (
 
 	"github.com/moio/booster/api"
 	"github.com/moio/booster/cmd"
+	"github.com/moio/booster/patch"
 
+	"github.com/docker/go-units"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -37,11 +40,14 @@ func main() {
 	app.EnableBashCompletion = true
 	app.Commands = []*cli.Command{
 		{
-			Name:      "diff",
-			Usage:     "generates a patch between sets of images",
+			Name:  "diff",
+			Usage: "generates a patch between sets of images",
+			Description: "Signatures, attestations, SBOMs and OCI referrers of new images are included in the patch if found in " +
+				"cosign's sha256-<digest>.sig, .att and .sbom tags or in the OCI referrers tag (sha256-<digest>). " +
+				"The OCI 1.1 Referrers API is not queried, so referrers only listed by registries via the API are not included",
 			ArgsUsage: "OLD_LIST_FILE NEW_LIST_FILE",
 			Action:    diff,
-			Flags: []cli.Flag{
+			Flags: flags(registryFlags, sourceRegistryFlags("source registries"), platformFlags, downloadFlags, signingFlags, []cli.Flag{
 				&cli.StringFlag{
 					Name:  "temp-dir",
 					Usage: "temporary directory for image downloads",
@@ -52,26 +58,76 @@ func main() {
 					Usage: "where to save the patch (default: autogenerated)",
 					Value: "",
 				},
-			},
+				&cli.BoolFlag{
+					Name:  "resume",
+					Usage: "resume an interrupted diff, skipping work recorded in the temporary directory",
+				},
+				&cli.StringFlag{
+					Name:  "split-size",
+					Usage: "split the patch into volumes of at most this size (eg. 4G, 700M), described by an index file",
+				},
+				&cli.BoolFlag{
+					Name:  "verify",
+					Usage: "apply the patch to a copy of the old images and check the result before declaring success",
+				},
+				&cli.StringFlag{
+					Name:  "report",
+					Usage: "write a report with sizes, savings and timings to this file, in Markdown format if it ends in .md and JSON otherwise",
+				},
+				&cli.BoolFlag{
+					Name:  "gzip-reconstruction",
+					Usage: "decompress gzip layers from any encoder, shipping data to rebuild them exactly in the patch",
+				},
+			}),
 		},
 		{
 			Name:      "apply",
-			Usage:     "applies a diff file to a container registry",
-			ArgsUsage: "OLD_LIST_FILE NEW_LIST_FILE DIFF_FILE DESTINATION",
+			Usage:     "applies one or more chained diff files to a container registry",
+			ArgsUsage: "DIFF_FILE... DESTINATION",
 			Action:    apply,
-			Flags: []cli.Flag{
+			Flags: flags(registryFlags, sourceRegistryFlags("the old source registry"), destinationRegistryFlags, platformFlags, downloadFlags, verificationFlags, []cli.Flag{
 				&cli.StringFlag{
 					Name:  "temp-dir",
 					Usage: "temporary directory for image downloads",
 					Value: "/tmp/booster",
 				},
+				&cli.StringFlag{
+					Name:  "old-source",
+					Usage: "registry or transport:path hosting the old image set (default: DESTINATION)",
+					Value: "",
+				},
+				&cli.StringSliceFlag{
+					Name:  "rewrite",
+					Usage: "rewrite rule for destination repository names: drop-registry, prefix:PREFIX=REPLACEMENT or regex:REGEX=REPLACEMENT (can be repeated, applied in order)",
+				},
+				&cli.StringFlag{
+					Name:  "rewrite-file",
+					Usage: "YAML file with rewrite rules, applied before --rewrite rules",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "download, decompress and check old images against the patch, then print resolved image references, tags that would be pushed or overwritten and estimated disk space and upload size, without uploading",
+				},
+			}),
+		},
+		{
+			Name:      "inspect",
+			Usage:     "describes a diff file without applying it",
+			ArgsUsage: "DIFF_FILE",
+			Action:    inspect,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "output format, text or json",
+					Value: "text",
+				},
 			},
 		},
 		{
 			Name:   "serve",
 			Usage:  "serves the booster HTTP API",
 			Action: serve,
-			Flags: []cli.Flag{
+			Flags: flags(signingFlags, verificationFlags, []cli.Flag{
 				&cli.IntFlag{
 					Name:  "port",
 					Usage: "TCP port for the API (default 5000)",
@@ -87,7 +143,11 @@ func main() {
 					Usage: "http address of the primary, if any",
 					Value: "",
 				},
-			},
+				&cli.BoolFlag{
+					Name:  "gzip-reconstruction",
+					Usage: "decompress gzip layers from any encoder, shipping data to rebuild them exactly in patches (must match on primary and replicas)",
+				},
+			}),
 		},
 	}
 
@@ -96,6 +156,149 @@ func main() {
 	}
 }
 
+// registryFlags configure access to all registries
+var registryFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "authfile",
+		Usage:   "path of the registry authentication file (default: containers auth.json and Docker config locations)",
+		EnvVars: []string{"REGISTRY_AUTH_FILE"},
+	},
+	&cli.StringFlag{
+		Name:  "registries-d",
+		Usage: "directory with registry configuration files (default: /etc/containers/registries.d)",
+	},
+	&cli.StringFlag{
+		Name:  "certs-d",
+		Usage: "directory with per-registry certificate subdirectories (default: /etc/containers/certs.d and /etc/docker/certs.d)",
+	},
+}
+
+// signingFlags configure patch signing
+var signingFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "sign-key",
+		Usage: "path of an ed25519 private key (PEM) to sign patches with",
+	},
+}
+
+// verificationFlags configure patch signature verification
+var verificationFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "trusted-keys",
+		Usage: "path of a file with ed25519 public keys (PEM) trusted to sign patches",
+	},
+	&cli.BoolFlag{
+		Name:  "insecure-allow-unsigned",
+		Usage: "accept unsigned patches and patches not signed by a trusted key",
+	},
+}
+
+// sourceRegistryFlags configure access to source registries
+func sourceRegistryFlags(description string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "src-creds",
+			Usage: "credentials for " + description + ", in USERNAME:PASSWORD format",
+		},
+		&cli.BoolFlag{
+			Name:  "src-tls-verify",
+			Usage: "require HTTPS and verify certificates when accessing " + description,
+			Value: true,
+		},
+		&cli.StringFlag{
+			Name:  "src-cert-dir",
+			Usage: "directory with certificates (*.crt) and client keys (*.cert, *.key) for " + description,
+		},
+	}
+}
+
+// destinationRegistryFlags configure access to the destination registry
+var destinationRegistryFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "dest-creds",
+		Usage: "credentials for the destination registry, in USERNAME:PASSWORD format",
+	},
+	&cli.BoolFlag{
+		Name:  "dest-tls-verify",
+		Usage: "require HTTPS and verify certificates when accessing the destination registry",
+		Value: true,
+	},
+	&cli.StringFlag{
+		Name:  "dest-cert-dir",
+		Usage: "directory with certificates (*.crt) and client keys (*.cert, *.key) for the destination registry",
+	},
+}
+
+// platformFlags select images from multi-platform images
+var platformFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "platform",
+		Usage: "platform to select from multi-platform images, in os/arch[/variant] format, can be repeated (default: host platform)",
+	},
+	&cli.BoolFlag{
+		Name:  "all-platforms",
+		Usage: "select all platforms from multi-platform images",
+	},
+}
+
+// downloadFlags configure image downloads
+var downloadFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "parallel-images",
+		Usage: "maximum number of images downloaded concurrently",
+		Value: 4,
+	},
+	&cli.IntFlag{
+		Name:  "retries",
+		Usage: "number of times a failed image download is retried, with exponential backoff",
+		Value: 3,
+	},
+}
+
+// flags concatenates lists of flags
+func flags(lists ...[]cli.Flag) []cli.Flag {
+	result := []cli.Flag{}
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+	return result
+}
+
+// registryOptions returns options from registryFlags and flags starting with prefix ("src" or "dest")
+func registryOptions(ctx *cli.Context, prefix string) cmd.RegistryOptions {
+	return cmd.RegistryOptions{
+		AuthFile:      ctx.String("authfile"),
+		Creds:         ctx.String(prefix + "-creds"),
+		TLSVerify:     ctx.Bool(prefix + "-tls-verify"),
+		CertDir:       ctx.String(prefix + "-cert-dir"),
+		RegistriesDir: ctx.String("registries-d"),
+		CertsDir:      ctx.String("certs-d"),
+	}
+}
+
+// downloadOptions returns options from downloadFlags
+func downloadOptions(ctx *cli.Context) (cmd.DownloadOptions, error) {
+	if ctx.Int("parallel-images") < 1 {
+		return cmd.DownloadOptions{}, errors.New("--parallel-images must be at least 1")
+	}
+	if ctx.Int("retries") < 0 {
+		return cmd.DownloadOptions{}, errors.New("--retries must not be negative")
+	}
+	return cmd.DownloadOptions{ParallelImages: ctx.Int("parallel-images"), Retries: ctx.Int("retries")}, nil
+}
+
+// platformSelection returns the selection from platformFlags
+func platformSelection(ctx *cli.Context) (patch.PlatformSelection, error) {
+	platforms := ctx.StringSlice("platform")
+	if err := cmd.ValidatePlatforms(platforms); err != nil {
+		return patch.PlatformSelection{}, err
+	}
+	if len(platforms) > 0 && ctx.Bool("all-platforms") {
+		return patch.PlatformSelection{}, errors.New("--platform and --all-platforms are mutually exclusive")
+	}
+	return patch.PlatformSelection{Platforms: platforms, All: ctx.Bool("all-platforms")}, nil
+}
+
 func serve(ctx *cli.Context) error {
 	path := ctx.String("path")
 	info, err := os.Stat(path)
@@ -106,7 +309,16 @@ func serve(ctx *cli.Context) error {
 		return errors.Errorf("%v is not a directory", path)
 	}
 
-	return api.Serve(path, ctx.Int("port"), ctx.String("primary"))
+	key, err := signKey(ctx)
+	if err != nil {
+		return err
+	}
+	v, err := verifier(ctx)
+	if err != nil {
+		return err
+	}
+
+	return api.Serve(path, ctx.Int("port"), ctx.String("primary"), key, v, ctx.Bool("gzip-reconstruction"))
 }
 
 func diff(ctx *cli.Context) error {
@@ -134,17 +346,43 @@ func diff(ctx *cli.Context) error {
 		output = fmt.Sprintf("%v-to-%v.patch", o, n)
 	}
 
-	return cmd.Diff(oldPath, newPath, tempDir, output)
+	srcCtx, err := cmd.NewSystemContext(registryOptions(ctx, "src"))
+	if err != nil {
+		return errors.Wrap(err, "Invalid source registry options")
+	}
+
+	platforms, err := platformSelection(ctx)
+	if err != nil {
+		return err
+	}
+
+	options, err := downloadOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	var splitSize int64
+	if s := ctx.String("split-size"); s != "" {
+		splitSize, err = units.RAMInBytes(s)
+		if err != nil || splitSize <= 0 {
+			return errors.Errorf("Invalid split size %v", s)
+		}
+	}
+
+	key, err := signKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	return cmd.Diff(oldPath, newPath, tempDir, output, ctx.App.Version, srcCtx, platforms, options, ctx.Bool("resume"), ctx.Bool("verify"), splitSize, key, ctx.String("report"), ctx.Bool("gzip-reconstruction"))
 }
 
 func apply(ctx *cli.Context) error {
-	if ctx.Args().Len() != 4 {
+	if ctx.Args().Len() < 2 {
 		cli.ShowSubcommandHelpAndExit(ctx, 1)
 	}
-	oldPath := ctx.Args().Get(0)
-	newPath := ctx.Args().Get(1)
-	diffPath := ctx.Args().Get(2)
-	destination := ctx.Args().Get(3)
+	diffPaths := ctx.Args().Slice()[:ctx.Args().Len()-1]
+	destination := ctx.Args().Get(ctx.Args().Len() - 1)
 
 	tempDir := ctx.String("temp-dir")
 	if err := os.MkdirAll(tempDir, 0700); err != nil {
@@ -156,5 +394,84 @@ func apply(ctx *cli.Context) error {
 		return errors.Wrapf(err, "Could not evaluate symlinks for %v", tempDir)
 	}
 
-	return cmd.Apply(oldPath, newPath, diffPath, tempDir, destination)
+	srcCtx, err := cmd.NewSystemContext(registryOptions(ctx, "src"))
+	if err != nil {
+		return errors.Wrap(err, "Invalid source registry options")
+	}
+	destCtx, err := cmd.NewSystemContext(registryOptions(ctx, "dest"))
+	if err != nil {
+		return errors.Wrap(err, "Invalid destination registry options")
+	}
+
+	platforms, err := platformSelection(ctx)
+	if err != nil {
+		return err
+	}
+
+	options, err := downloadOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	rewrites, err := rewriteRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	v, err := verifier(ctx)
+	if err != nil {
+		return err
+	}
+
+	return cmd.Apply(diffPaths, tempDir, destination, ctx.String("old-source"), rewrites, srcCtx, destCtx, platforms, options, ctx.Bool("dry-run"), v)
+}
+
+// signKey returns the key from the sign-key flag, if any
+func signKey(ctx *cli.Context) (ed25519.PrivateKey, error) {
+	path := ctx.String("sign-key")
+	if path == "" {
+		return nil, nil
+	}
+	return patch.ReadPrivateKey(path)
+}
+
+// verifier returns a patch signature verifier from the trusted-keys and insecure-allow-unsigned flags
+func verifier(ctx *cli.Context) (*patch.Verifier, error) {
+	result := &patch.Verifier{AllowUnsigned: ctx.Bool("insecure-allow-unsigned")}
+	if path := ctx.String("trusted-keys"); path != "" {
+		keys, err := patch.ReadPublicKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		result.TrustedKeys = keys
+	}
+	return result, nil
+}
+
+// rewriteRules returns rewrite rules from the rewrite-file and rewrite flags
+func rewriteRules(ctx *cli.Context) (cmd.Rewrites, error) {
+	rewrites := cmd.Rewrites{}
+	if path := ctx.String("rewrite-file"); path != "" {
+		fileRewrites, err := cmd.ReadRewrites(path)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, fileRewrites...)
+	}
+	for _, rule := range ctx.StringSlice("rewrite") {
+		rewrite, err := cmd.ParseRewrite(rule)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
+func inspect(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelpAndExit(ctx, 1)
+	}
+
+	return cmd.Inspect(ctx.Args().Get(0), ctx.String("format"))
 }
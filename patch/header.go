@@ -0,0 +1,132 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Magic is written at the very beginning of every booster patch file
+const Magic = "BOOSTER\x00"
+
+// FormatVersion is the version of the header format written by WriteHeader
+const FormatVersion uint32 = 1
+
+// maxHeaderLength limits memory allocated while reading corrupt headers
+const maxHeaderLength = 64 * 1024 * 1024
+
+// Image identifies an image in a set by name and manifest digest
+type Image struct {
+	Name   string
+	Digest digest.Digest
+	// Destination is the repository and tag the image is uploaded to, if different from Name
+	Destination string `json:",omitempty"`
+}
+
+// Artifact is a signature, attestation, SBOM or other artifact related to a new image, stored under a tag
+// derived from the digest of the image (eg. cosign's "sha256-<hex>.sig" or the OCI referrers tag "sha256-<hex>")
+type Artifact struct {
+	// Image is the name of the new image the artifact relates to
+	Image string
+	// Tag is the tag of the artifact, in the repository of Image
+	Tag    string
+	Digest digest.Digest
+}
+
+// PlatformSelection selects images from multi-platform images (manifest lists and OCI indexes)
+// if empty, only the image for the host platform is selected
+type PlatformSelection struct {
+	// Platforms lists platforms in os/arch[/variant] format
+	Platforms []string
+	// All selects all platforms
+	All bool
+}
+
+// Settings describes how the patch was created
+type Settings struct {
+	Compression string
+	Quality     int32
+	Platforms   PlatformSelection
+	// GzipReconstruction is true if gzip layers from any encoder were decompressed along with reconstruction data
+	GzipReconstruction bool `json:",omitempty"`
+	// DeflateEncoder identifies the encoder gzip layers were checked against when decompressed, which has to be used
+	// to recompress them. Empty in patches created by older booster versions
+	DeflateEncoder string `json:",omitempty"`
+}
+
+// Header describes a patch. It is written before the wharf patch stream
+type Header struct {
+	BoosterVersion string
+	OldImages      []Image
+	NewImages      []Image
+	// NewImagesSize is the total size of new image files, as stored in a registry (compressed)
+	NewImagesSize int64
+	Settings      Settings
+	// Artifacts relate to new images and are uploaded along with them
+	Artifacts []Artifact `json:",omitempty"`
+}
+
+// WriteHeader writes magic bytes, format version and header to w
+func WriteHeader(w io.Writer, h *Header) error {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return errors.Wrap(err, "error while marshalling patch header")
+	}
+
+	if _, err := io.WriteString(w, Magic); err != nil {
+		return errors.Wrap(err, "error while writing patch header")
+	}
+	if err := binary.Write(w, binary.LittleEndian, FormatVersion); err != nil {
+		return errors.Wrap(err, "error while writing patch header")
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(body))); err != nil {
+		return errors.Wrap(err, "error while writing patch header")
+	}
+	if _, err := w.Write(body); err != nil {
+		return errors.Wrap(err, "error while writing patch header")
+	}
+	return nil
+}
+
+// ReadHeader reads a header written by WriteHeader from r
+// returns the header and the number of bytes read, which is the offset of the wharf patch stream
+func ReadHeader(r io.Reader) (*Header, int64, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, 0, errors.Wrap(err, "error while reading patch header")
+	}
+	if !bytes.Equal(magic, []byte(Magic)) {
+		return nil, 0, errors.New("not a booster patch file, or created by an older booster version")
+	}
+
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, 0, errors.Wrap(err, "error while reading patch header")
+	}
+	if version > FormatVersion {
+		return nil, 0, errors.Errorf("unsupported patch format version %v (max supported: %v), please upgrade booster", version, FormatVersion)
+	}
+
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, 0, errors.Wrap(err, "error while reading patch header")
+	}
+	if length > maxHeaderLength {
+		return nil, 0, errors.Errorf("patch header too long (%v bytes), file is probably corrupt", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, errors.Wrap(err, "error while reading patch header")
+	}
+	var h Header
+	if err := json.Unmarshal(body, &h); err != nil {
+		return nil, 0, errors.Wrap(err, "error while unmarshalling patch header")
+	}
+
+	return &h, int64(len(Magic)) + 4 + 4 + int64(length), nil
+}
@@ -0,0 +1,187 @@
+package patch
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// SignatureSuffix is appended to patch file names to obtain the names of their detached signatures
+const SignatureSuffix = ".sig"
+
+// signatureContext is prepended to patch digests before signing, so that signatures can't be reused for other purposes
+const signatureContext = "booster patch signature v1\x00"
+
+// Signature is a detached ed25519 signature of a patch file, covering both header and wharf patch stream
+type Signature struct {
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+// Fingerprint returns a short identifier of an ed25519 public key
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ReadPrivateKey reads an ed25519 private key from a PKCS #8 PEM file
+// (eg. as generated by `openssl genpkey -algorithm ed25519`)
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while reading key file %v", path)
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.Errorf("%v is not a PEM private key file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while parsing key file %v", path)
+	}
+	result, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%v is not an ed25519 private key", path)
+	}
+	return result, nil
+}
+
+// ReadPublicKeys reads ed25519 public keys from a PEM file with one or more PKIX public keys
+// (eg. as generated by `openssl pkey -pubout`)
+func ReadPublicKeys(path string) ([]ed25519.PublicKey, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while reading key file %v", path)
+	}
+
+	result := []ed25519.PublicKey{}
+	for {
+		var block *pem.Block
+		block, bytes = pem.Decode(bytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while parsing key file %v", path)
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("%v contains a key which is not an ed25519 public key", path)
+		}
+		result = append(result, publicKey)
+	}
+	if len(result) == 0 {
+		return nil, errors.Errorf("%v does not contain any PEM public key", path)
+	}
+	return result, nil
+}
+
+// Sign signs the patch file at patchPath with key, writing a detached signature to signaturePath
+func Sign(patchPath string, signaturePath string, key ed25519.PrivateKey) error {
+	message, err := signedMessage(patchPath)
+	if err != nil {
+		return err
+	}
+	signature := Signature{
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, message),
+	}
+
+	bytes, err := json.Marshal(signature)
+	if err != nil {
+		return errors.Wrap(err, "error while marshalling signature")
+	}
+	if err := os.WriteFile(signaturePath, bytes, 0644); err != nil {
+		return errors.Wrapf(err, "error while writing signature file %v", signaturePath)
+	}
+	return nil
+}
+
+// signedMessage returns the message signed for the patch file at patchPath
+func signedMessage(patchPath string) ([]byte, error) {
+	f, err := os.Open(patchPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while opening patch file %v", patchPath)
+	}
+	defer f.Close()
+
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, errors.Wrapf(err, "error while reading patch file %v", patchPath)
+	}
+	return h.Sum([]byte(signatureContext)), nil
+}
+
+// Verifier checks patch signatures against trusted keys
+type Verifier struct {
+	TrustedKeys []ed25519.PublicKey
+	// AllowUnsigned accepts unsigned or badly signed patches, with a warning
+	AllowUnsigned bool
+}
+
+// Verify returns an error if the patch file at patchPath does not have a valid signature at signaturePath
+// by a trusted key, unless AllowUnsigned is set
+func (v *Verifier) Verify(patchPath string, signaturePath string) error {
+	fingerprint, err := v.verify(patchPath, signaturePath)
+	if err != nil {
+		if v.AllowUnsigned {
+			log.Warn().Str("patch", patchPath).Err(err).Msg("Patch signature not verified, proceeding as unsigned patches are allowed")
+			return nil
+		}
+		return errors.Wrap(err, "patch rejected (use --insecure-allow-unsigned to skip signature verification)")
+	}
+	log.Info().Str("patch", patchPath).Str("key", fingerprint).Msg("Patch signature verified")
+	return nil
+}
+
+// verify checks the signature of a patch file, returning the fingerprint of the signing key
+func (v *Verifier) verify(patchPath string, signaturePath string) (string, error) {
+	bytes, err := os.ReadFile(signaturePath)
+	if os.IsNotExist(err) {
+		return "", errors.Errorf("patch %v is not signed (no %v found)", patchPath, signaturePath)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error while reading signature file %v", signaturePath)
+	}
+	var signature Signature
+	if err := json.Unmarshal(bytes, &signature); err != nil {
+		return "", errors.Wrapf(err, "error while parsing signature file %v", signaturePath)
+	}
+	if len(signature.PublicKey) != ed25519.PublicKeySize {
+		return "", errors.Errorf("invalid public key in signature file %v", signaturePath)
+	}
+
+	fingerprint := Fingerprint(signature.PublicKey)
+	trusted := false
+	for _, key := range v.TrustedKeys {
+		if key.Equal(signature.PublicKey) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return "", errors.Errorf("patch %v is signed by untrusted key %v", patchPath, fingerprint)
+	}
+
+	message, err := signedMessage(patchPath)
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(signature.PublicKey, message, signature.Signature) {
+		return "", errors.Errorf("patch %v has an invalid signature by key %v", patchPath, fingerprint)
+	}
+	return fingerprint, nil
+}
@@ -0,0 +1,109 @@
+package patch
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newKey returns a new ed25519 key pair
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestVerify(t *testing.T) {
+	trustedPublic, trustedPrivate := newKey(t)
+	_, untrustedPrivate := newKey(t)
+
+	cases := []struct {
+		name string
+		// prepare changes a patch, signed by the trusted key, and its signature
+		prepare func(t *testing.T, patchPath string, signaturePath string)
+		valid   bool
+	}{
+		{"trusted key", func(t *testing.T, patchPath string, signaturePath string) {}, true},
+		{"untrusted key", func(t *testing.T, patchPath string, signaturePath string) {
+			if err := Sign(patchPath, signaturePath, untrustedPrivate); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"wrong key", func(t *testing.T, patchPath string, signaturePath string) {
+			// signed by another key, but claiming to be signed by the trusted one
+			if err := Sign(patchPath, signaturePath, untrustedPrivate); err != nil {
+				t.Fatal(err)
+			}
+			bytes, err := os.ReadFile(signaturePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var signature Signature
+			if err := json.Unmarshal(bytes, &signature); err != nil {
+				t.Fatal(err)
+			}
+			signature.PublicKey = trustedPublic
+			bytes, err = json.Marshal(signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(signaturePath, bytes, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"tampered patch", func(t *testing.T, patchPath string, signaturePath string) {
+			f, err := os.OpenFile(patchPath, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte{0}); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"missing signature", func(t *testing.T, patchPath string, signaturePath string) {
+			if err := os.Remove(signaturePath); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"corrupt signature", func(t *testing.T, patchPath string, signaturePath string) {
+			if err := os.WriteFile(signaturePath, []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			patchPath := filepath.Join(dir, "patch")
+			signaturePath := patchPath + SignatureSuffix
+			if err := os.WriteFile(patchPath, []byte("booster patch contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := Sign(patchPath, signaturePath, trustedPrivate); err != nil {
+				t.Fatal(err)
+			}
+			c.prepare(t, patchPath, signaturePath)
+
+			err := (&Verifier{TrustedKeys: []ed25519.PublicKey{trustedPublic}}).Verify(patchPath, signaturePath)
+			if c.valid && err != nil {
+				t.Fatalf("valid signature rejected: %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Fatal("invalid signature accepted")
+			}
+
+			// with AllowUnsigned, any patch is accepted
+			if err := (&Verifier{TrustedKeys: []ed25519.PublicKey{trustedPublic}, AllowUnsigned: true}).Verify(patchPath, signaturePath); err != nil {
+				t.Fatalf("patch rejected although unsigned patches are allowed: %v", err)
+			}
+		})
+	}
+}
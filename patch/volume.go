@@ -0,0 +1,272 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// IndexSuffix is appended to patch file names to obtain the names of indexes of split patches
+const IndexSuffix = ".index"
+
+// volumeSuffix matches suffixes of volume file names
+var volumeSuffix = regexp.MustCompile(`\.[0-9]{3,}$`)
+
+// Index describes a patch split into volumes
+type Index struct {
+	// Size is the total size of the patch
+	Size    int64
+	Volumes []Volume
+}
+
+// Volume is a part of a split patch
+type Volume struct {
+	// Name is the file name of the volume, relative to the index
+	Name   string
+	Size   int64
+	Digest digest.Digest
+}
+
+// VolumePath returns the path of the i-th volume (starting from 0) of the patch at patchPath
+func VolumePath(patchPath string, i int) string {
+	return fmt.Sprintf("%v.%03d", patchPath, i+1)
+}
+
+// IndexPath returns the index path of a split patch, given the path of its index or of any of its volumes
+// if path is not part of a split patch, it is returned unchanged along with false
+func IndexPath(path string) (string, bool) {
+	if strings.HasSuffix(path, IndexSuffix) {
+		return path, true
+	}
+	if volumeSuffix.MatchString(path) {
+		indexPath := volumeSuffix.ReplaceAllString(path, "") + IndexSuffix
+		if _, err := os.Stat(indexPath); err == nil {
+			return indexPath, true
+		}
+	}
+	return path, false
+}
+
+// Split splits the patch file at patchPath into volumes of at most volumeSize bytes, described by an index
+// the patch file is only removed once all volumes and the index are written, so additional disk space
+// as large as the patch is needed. Any previous signature of the index is removed
+// returns the path of the index
+func Split(patchPath string, volumeSize int64) (string, error) {
+	if volumeSize <= 0 {
+		return "", errors.Errorf("invalid volume size %v", volumeSize)
+	}
+	info, err := os.Stat(patchPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "error while reading patch file %v", patchPath)
+	}
+	size := info.Size()
+	count := int((size + volumeSize - 1) / volumeSize)
+	if count == 0 {
+		count = 1
+	}
+
+	index := Index{Size: size, Volumes: make([]Volume, count)}
+	for i := 0; i < count; i++ {
+		start := int64(i) * volumeSize
+		end := start + volumeSize
+		if end > size {
+			end = size
+		}
+
+		volumePath := VolumePath(patchPath, i)
+		d, err := copyRange(patchPath, start, end, volumePath)
+		if err != nil {
+			return "", err
+		}
+		index.Volumes[i] = Volume{Name: filepath.Base(volumePath), Size: end - start, Digest: d}
+	}
+
+	indexPath := patchPath + IndexSuffix
+	bytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling index")
+	}
+	if err := os.WriteFile(indexPath, bytes, 0644); err != nil {
+		return "", errors.Wrapf(err, "error while writing index %v", indexPath)
+	}
+	if err := os.Remove(indexPath + SignatureSuffix); err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "error while removing stale signature of %v", indexPath)
+	}
+	if err := os.Remove(patchPath); err != nil {
+		return "", errors.Wrapf(err, "error while removing split patch file %v", patchPath)
+	}
+	return indexPath, nil
+}
+
+// copyRange copies bytes from start to end of the file at sourcePath to destinationPath, returning their digest
+func copyRange(sourcePath string, start int64, end int64, destinationPath string) (digest.Digest, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "error while opening patch file %v", sourcePath)
+	}
+	defer source.Close()
+
+	destination, err := os.Create(destinationPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "error while creating volume %v", destinationPath)
+	}
+	digester := digest.Canonical.Digester()
+	_, err = io.Copy(io.MultiWriter(destination, digester.Hash()), io.NewSectionReader(source, start, end-start))
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error while writing volume %v", destinationPath)
+	}
+	return digester.Digest(), nil
+}
+
+// File is a patch file, possibly split into volumes, which is read as a single stream
+type File struct {
+	files  []*os.File
+	index  Index
+	offset int64
+}
+
+// Open opens a patch file, or a split patch given the path of its index or first volume
+// volumes are checked to exist and have the expected size, use CheckVolumes to also check contents
+func Open(path string) (*File, error) {
+	indexPath, split := IndexPath(path)
+	if !split {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while opening patch file %v", path)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "error while opening patch file %v", path)
+		}
+		return &File{files: []*os.File{f}, index: Index{Size: info.Size(), Volumes: []Volume{{Name: path, Size: info.Size()}}}}, nil
+	}
+
+	bytes, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while reading index %v", indexPath)
+	}
+	result := &File{}
+	if err := json.Unmarshal(bytes, &result.index); err != nil {
+		return nil, errors.Wrapf(err, "error while parsing index %v", indexPath)
+	}
+
+	var total int64
+	for _, volume := range result.index.Volumes {
+		// volumes must be next to the index
+		if volume.Name != filepath.Base(volume.Name) || volume.Name == "." || volume.Name == ".." {
+			result.Close()
+			return nil, errors.Errorf("index %v is corrupt: invalid volume name %v", indexPath, volume.Name)
+		}
+		volumePath := filepath.Join(filepath.Dir(indexPath), volume.Name)
+		f, err := os.Open(volumePath)
+		if os.IsNotExist(err) {
+			result.Close()
+			return nil, errors.Errorf("volume %v is missing", volumePath)
+		}
+		if err != nil {
+			result.Close()
+			return nil, errors.Wrapf(err, "error while opening volume %v", volumePath)
+		}
+		result.files = append(result.files, f)
+
+		info, err := f.Stat()
+		if err != nil {
+			result.Close()
+			return nil, errors.Wrapf(err, "error while opening volume %v", volumePath)
+		}
+		if info.Size() != volume.Size {
+			result.Close()
+			return nil, errors.Errorf("volume %v is corrupt: expected %v bytes, found %v", volumePath, volume.Size, info.Size())
+		}
+		total += volume.Size
+	}
+	if total != result.index.Size {
+		result.Close()
+		return nil, errors.Errorf("index %v is corrupt: volumes add up to %v bytes, expected %v", indexPath, total, result.index.Size)
+	}
+
+	return result, nil
+}
+
+// CheckVolumes returns an error naming the first volume whose contents do not match the index
+// it does nothing for patches which are not split
+func (f *File) CheckVolumes() error {
+	for i, volume := range f.index.Volumes {
+		if volume.Digest == "" {
+			continue
+		}
+		d, err := digest.Canonical.FromReader(io.NewSectionReader(f.files[i], 0, volume.Size))
+		if err != nil {
+			return errors.Wrapf(err, "error while reading volume %v", f.files[i].Name())
+		}
+		if d != volume.Digest {
+			return errors.Errorf("volume %v is corrupt: digest %v does not match index", f.files[i].Name(), d)
+		}
+	}
+	return nil
+}
+
+// Size returns the total size of the patch
+func (f *File) Size() int64 {
+	return f.index.Size
+}
+
+// Read implements io.Reader
+func (f *File) Read(p []byte) (int, error) {
+	var start int64
+	for i, volume := range f.index.Volumes {
+		if f.offset < start+volume.Size {
+			if remaining := start + volume.Size - f.offset; int64(len(p)) > remaining {
+				p = p[:remaining]
+			}
+			n, err := f.files[i].ReadAt(p, f.offset-start)
+			f.offset += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		start += volume.Size
+	}
+	return 0, io.EOF
+}
+
+// Seek implements io.Seeker
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.index.Size
+	default:
+		return 0, errors.Errorf("invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Errorf("invalid offset %v", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close closes all volumes
+func (f *File) Close() error {
+	var result error
+	for _, file := range f.files {
+		if err := file.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,191 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// splitPatch writes a patch of size bytes to dir and splits it into volumes of volumeSize bytes
+// returns the patch contents and the path of the index
+func splitPatch(t *testing.T, dir string, size int, volumeSize int64) ([]byte, string) {
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	patchPath := filepath.Join(dir, "patch")
+	if err := os.WriteFile(patchPath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	indexPath, err := Split(patchPath, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents, indexPath
+}
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		name       string
+		size       int
+		volumeSize int64
+		volumes    int
+	}{
+		{"empty patch", 0, 10, 1},
+		{"one volume", 7, 10, 1},
+		{"exact multiple", 30, 10, 3},
+		{"partial last volume", 25, 10, 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			contents, indexPath := splitPatch(t, dir, c.size, c.volumeSize)
+			patchPath := filepath.Join(dir, "patch")
+			if _, err := os.Stat(patchPath); !os.IsNotExist(err) {
+				t.Fatal("split patch file not removed")
+			}
+
+			// a split patch can be opened via its index or any of its volumes
+			for _, path := range []string{indexPath, VolumePath(patchPath, 0), VolumePath(patchPath, c.volumes-1)} {
+				f, err := Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(f.index.Volumes) != c.volumes {
+					t.Fatalf("%v volumes, expected %v", len(f.index.Volumes), c.volumes)
+				}
+				if f.Size() != int64(c.size) {
+					t.Fatalf("size %v, expected %v", f.Size(), c.size)
+				}
+				if err := f.CheckVolumes(); err != nil {
+					t.Fatal(err)
+				}
+				read, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(read, contents) {
+					t.Fatal("reassembled patch differs from the original")
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenInvalidVolumes(t *testing.T) {
+	cases := []struct {
+		name string
+		// corrupt changes volumes or the index of a patch split into 3 volumes
+		corrupt func(t *testing.T, patchPath string, index *Index)
+	}{
+		{"missing volume", func(t *testing.T, patchPath string, index *Index) {
+			if err := os.Remove(VolumePath(patchPath, 1)); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"truncated volume", func(t *testing.T, patchPath string, index *Index) {
+			if err := os.Truncate(VolumePath(patchPath, 1), 5); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"volume in parent directory", func(t *testing.T, patchPath string, index *Index) {
+			index.Volumes[1].Name = filepath.Join("..", index.Volumes[1].Name)
+		}},
+		{"volume in subdirectory", func(t *testing.T, patchPath string, index *Index) {
+			index.Volumes[1].Name = filepath.Join("sub", index.Volumes[1].Name)
+		}},
+		{"absolute volume path", func(t *testing.T, patchPath string, index *Index) {
+			index.Volumes[1].Name = VolumePath(patchPath, 1)
+		}},
+		{"parent directory as volume", func(t *testing.T, patchPath string, index *Index) {
+			index.Volumes[1].Name = ".."
+		}},
+		{"empty volume name", func(t *testing.T, patchPath string, index *Index) {
+			index.Volumes[1].Name = ""
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, indexPath := splitPatch(t, dir, 25, 10)
+			// make volumes reachable via the names above, too, so that only the name check rejects them
+			if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			patchPath := filepath.Join(dir, "patch")
+			volume, err := os.ReadFile(VolumePath(patchPath, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range []string{filepath.Join(dir, "sub"), filepath.Dir(dir)} {
+				if err := os.WriteFile(filepath.Join(d, filepath.Base(VolumePath(patchPath, 1))), volume, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var index Index
+			readIndex(t, indexPath, &index)
+			c.corrupt(t, patchPath, &index)
+			writeIndex(t, indexPath, &index)
+
+			if f, err := Open(indexPath); err == nil {
+				f.Close()
+				t.Fatal("invalid split patch opened")
+			}
+		})
+	}
+}
+
+func TestCheckVolumesCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	_, indexPath := splitPatch(t, dir, 25, 10)
+	volumePath := VolumePath(filepath.Join(dir, "patch"), 2)
+	volume, err := os.ReadFile(volumePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume[0]++
+	if err := os.WriteFile(volumePath, volume, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// same size, so Open does not notice
+	f, err := Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.CheckVolumes(); err == nil {
+		t.Fatal("corrupt volume not detected")
+	}
+}
+
+// readIndex reads the index at indexPath into index
+func readIndex(t *testing.T, indexPath string, index *Index) {
+	bytes, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(bytes, index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeIndex writes index to indexPath
+func writeIndex(t *testing.T, indexPath string, index *Index) {
+	bytes, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(indexPath, bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -16,4 +16,4 @@ echo ubuntu:bionic-20210702 > new.txt
 booster diff old.txt new.txt
 
 # Apply the patch onto the registry
-booster apply old.txt new.txt old-to-new.patch localhost:5001
+booster apply --dest-tls-verify=false --insecure-allow-unsigned old-to-new.patch localhost:5001
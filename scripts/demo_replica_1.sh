@@ -14,7 +14,7 @@ docker run -d \
   -p 5004:5000 \
   -v `pwd`/replica_1:/var/lib/registry \
   --link $PRIMARY_BOOSTER_ID:primary-booster \
-  ghcr.io/moio/booster:latest --primary=http://primary-booster:5000
+  ghcr.io/moio/booster:latest --primary=http://primary-booster:5000 --insecure-allow-unsigned
 )
 
 echo "Replica REGISTRY running at http://localhost:5003"
@@ -29,6 +29,15 @@ func (s *FileSet) Add(file string) {
 	s.files[file] = true
 }
 
+// AddWithParents adds a file and all of its parent directories
+func (s *FileSet) AddWithParents(file string) {
+	s.Add(file)
+	for file != filepath.Dir(file) {
+		file = filepath.Dir(file)
+		s.Add(file)
+	}
+}
+
 // Walk runs a function on all files in the set
 func (s *FileSet) Walk(f func(file string)) {
 	for file := range s.files {
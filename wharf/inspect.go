@@ -0,0 +1,178 @@
+package wharf
+
+import (
+	"io"
+
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// File statuses in a patch
+const (
+	Added    = "added"
+	Modified = "modified"
+	Reused   = "reused"
+)
+
+// FileInfo describes how a patch produces a file
+type FileInfo struct {
+	Path string
+	Size int64
+	// Status is one of Added, Modified or Reused
+	Status string
+	// OperationSize is the (approximate) number of compressed patch bytes for this file
+	OperationSize int64
+}
+
+// PatchInfo describes a patch
+type PatchInfo struct {
+	// OldContainer is the set of files the patch applies to
+	OldContainer *tlc.Container
+	// NewContainer is the set of files the patch produces
+	NewContainer *tlc.Container
+	// Files describes each file in NewContainer
+	Files []FileInfo
+}
+
+// Inspect reads a patch, starting at offset bytes in patch (of size bytes), without applying it
+func Inspect(patch io.ReadSeeker, size int64, offset int64) (*PatchInfo, error) {
+	counter := &countingReadSeeker{rs: patch}
+	patchSource, err := seeksource.NewWithSize(counter, size).Section(offset, size-offset)
+	if err != nil {
+		return nil, errors.WithMessage(err, "seeking patch stream")
+	}
+	if _, err := patchSource.Resume(nil); err != nil {
+		return nil, errors.WithMessage(err, "seeking patch stream")
+	}
+
+	// code adapted from patcher.New, which does not expose the decompressed wire
+	rawWire := wire.NewReadContext(patchSource)
+	if err := rawWire.ExpectMagic(pwr.PatchMagic); err != nil {
+		return nil, errors.WithMessage(err, "reading patch magic")
+	}
+	header := &pwr.PatchHeader{}
+	if err := rawWire.ReadMessage(header); err != nil {
+		return nil, errors.WithMessage(err, "reading patch header")
+	}
+	rctx, err := pwr.DecompressWire(rawWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decompressing patch")
+	}
+
+	result := &PatchInfo{OldContainer: &tlc.Container{}, NewContainer: &tlc.Container{}}
+	if err := rctx.ReadMessage(result.OldContainer); err != nil {
+		return nil, errors.WithMessage(err, "reading old container")
+	}
+	if err := rctx.ReadMessage(result.NewContainer); err != nil {
+		return nil, errors.WithMessage(err, "reading new container")
+	}
+
+	oldPaths := map[string]bool{}
+	for _, file := range result.OldContainer.Files {
+		oldPaths[file.Path] = true
+	}
+
+	for i, file := range result.NewContainer.Files {
+		start := counter.offset
+		reused, err := skipFile(rctx, int64(i), result.OldContainer, result.NewContainer)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "reading operations for %v", file.Path)
+		}
+
+		status := Modified
+		if reused {
+			status = Reused
+		} else if !oldPaths[file.Path] {
+			status = Added
+		}
+		result.Files = append(result.Files, FileInfo{
+			Path:          file.Path,
+			Size:          file.Size,
+			Status:        status,
+			OperationSize: counter.offset - start,
+		})
+	}
+
+	return result, nil
+}
+
+// skipFile reads all operations for a file in the new container
+// returns true if the file is a full copy of a file in the old container
+func skipFile(rctx *wire.ReadContext, fileIndex int64, oldContainer *tlc.Container, newContainer *tlc.Container) (bool, error) {
+	sh := &pwr.SyncHeader{}
+	if err := rctx.ReadMessage(sh); err != nil {
+		return false, err
+	}
+	if sh.FileIndex != fileIndex {
+		return false, errors.Errorf("corrupted patch: expected file %d, got file %d", fileIndex, sh.FileIndex)
+	}
+
+	reused := false
+	op := &pwr.SyncOp{}
+	switch sh.Type {
+	case pwr.SyncHeader_RSYNC:
+		first := true
+		for {
+			if err := rctx.ReadMessage(op); err != nil {
+				return false, err
+			}
+			if op.Type == pwr.SyncOp_HEY_YOU_DID_IT {
+				return reused, nil
+			}
+			if first {
+				// same logic as patcher's isFullFileOp
+				newFile := newContainer.Files[fileIndex]
+				reused = op.Type == pwr.SyncOp_BLOCK_RANGE && op.BlockIndex == 0 &&
+					oldContainer.Files[op.FileIndex].Size == newFile.Size &&
+					op.BlockSpan == pwr.ComputeNumBlocks(newFile.Size)
+				first = false
+			}
+		}
+	case pwr.SyncHeader_BSDIFF:
+		bh := &pwr.BsdiffHeader{}
+		if err := rctx.ReadMessage(bh); err != nil {
+			return false, err
+		}
+		ctrl := &bsdiff.Control{}
+		for !ctrl.Eof {
+			if err := rctx.ReadMessage(ctrl); err != nil {
+				return false, err
+			}
+		}
+		if err := rctx.ReadMessage(op); err != nil {
+			return false, err
+		}
+		if op.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+			return false, errors.Errorf("corrupted patch: expected sentinel after bsdiff series, got %s", op.Type)
+		}
+		return false, nil
+	default:
+		return false, errors.Errorf("unknown patch series kind %d", sh.Type)
+	}
+}
+
+// countingReadSeeker keeps track of the offset of an io.ReadSeeker
+type countingReadSeeker struct {
+	rs     io.ReadSeeker
+	offset int64
+}
+
+// Read implements io.Reader
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.rs.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (c *countingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	n, err := c.rs.Seek(offset, whence)
+	if err == nil {
+		c.offset = n
+	}
+	return n, err
+}
@@ -5,7 +5,7 @@ import (
 	"github.com/itchio/headway/state"
 	"github.com/itchio/lake/pools/fspool"
 	"github.com/itchio/lake/tlc"
-	"github.com/itchio/savior/filesource"
+	"github.com/itchio/savior/seeksource"
 	_ "github.com/itchio/wharf/compressors/cbrotli"
 	_ "github.com/itchio/wharf/decompressors/cbrotli"
 	"github.com/itchio/wharf/pwr"
@@ -16,6 +16,17 @@ import (
 	"io/ioutil"
 )
 
+// compressionSettings are used to compress all patches
+var compressionSettings = pwr.CompressionSettings{
+	Algorithm: pwr.CompressionAlgorithm_BROTLI,
+	Quality:   7, // "plateau" for brotli, see https://blogs.akamai.com/2016/02/understanding-brotlis-potential.html
+}
+
+// CompressionSettings returns the name of the compression algorithm and quality used in patches
+func CompressionSettings() (string, int32) {
+	return compressionSettings.Algorithm.String(), compressionSettings.Quality
+}
+
 // CreatePatch writes a patch from files in oldPath filtered via oldFilter to files in newPath filtered via newFilter
 // and writes it to a writer
 func CreatePatch(oldPath string, oldFilter tlc.FilterFunc, newPath string, newFilter tlc.FilterFunc, writer io.Writer) (err error) {
@@ -47,11 +58,8 @@ func CreatePatch(oldPath string, oldFilter tlc.FilterFunc, newPath string, newFi
 		TargetContainer: oldSignature.Container,
 		TargetSignature: oldSignature.Hashes,
 
-		Consumer: &state.Consumer{},
-		Compression: &pwr.CompressionSettings{
-			Algorithm: pwr.CompressionAlgorithm_BROTLI,
-			Quality:   7, // "plateau" for brotli, see https://blogs.akamai.com/2016/02/understanding-brotlis-potential.html
-		},
+		Consumer:    &state.Consumer{},
+		Compression: &compressionSettings,
 	}
 
 	err = dctx.WritePatch(context.Background(), writer, ioutil.Discard)
@@ -62,16 +70,19 @@ func CreatePatch(oldPath string, oldFilter tlc.FilterFunc, newPath string, newFi
 	return nil
 }
 
-// Apply applies a patch to a directory. Returns patch size or error
-func Apply(patchPath string, directory string, tempDir string) (int64, error) {
-	patchSource, err := filesource.Open(patchPath)
+// Apply applies a patch, starting at offset bytes in patch (of size bytes), to a directory
+func Apply(patch io.ReadSeeker, size int64, offset int64, directory string, tempDir string) error {
+	patchSource, err := seeksource.NewWithSize(patch, size).Section(offset, size-offset)
 	if err != nil {
-		return 0, errors.WithMessage(err, "opening patchPath")
+		return errors.WithMessage(err, "seeking patch stream")
+	}
+	if _, err := patchSource.Resume(nil); err != nil {
+		return errors.WithMessage(err, "seeking patch stream")
 	}
 
 	p, err := patcher.New(patchSource, &state.Consumer{})
 	if err != nil {
-		return 0, errors.WithMessage(err, "creating patcher")
+		return errors.WithMessage(err, "creating patcher")
 	}
 
 	targetPool := fspool.New(p.GetTargetContainer(), directory)
@@ -84,18 +95,18 @@ func Apply(patchPath string, directory string, tempDir string) (int64, error) {
 		StageFolder:     tempDir,
 	})
 	if err != nil {
-		return 0, errors.WithMessage(err, "creating overlay bowl")
+		return errors.WithMessage(err, "creating overlay bowl")
 	}
 
 	err = p.Resume(nil, targetPool, bwl)
 	if err != nil {
-		return 0, errors.WithMessage(err, "patching")
+		return errors.WithMessage(err, "patching")
 	}
 
 	err = bwl.Commit()
 	if err != nil {
-		return 0, errors.WithMessage(err, "committing bowl")
+		return errors.WithMessage(err, "committing bowl")
 	}
 
-	return patchSource.Size(), nil
+	return nil
 }